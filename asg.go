@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	asTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"math/rand/v2"
+	"os"
+)
+
+// getAutoScalingGroupInstanceIDs returns IDs of the in-service instances of the given Auto Scaling group
+func getAutoScalingGroupInstanceIDs(name string) ([]string, error) {
+	client := autoscaling.NewFromConfig(awsConfig)
+	ctx, cancel := apiContext()
+	defer cancel()
+	result, err := client.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{name},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe auto scaling group: %v", err)
+	}
+	if len(result.AutoScalingGroups) == 0 {
+		return nil, fmt.Errorf("auto scaling group %q not found", name)
+	}
+
+	var ids []string
+	for _, instance := range result.AutoScalingGroups[0].Instances {
+		if instance.LifecycleState == asTypes.LifecycleStateInService {
+			ids = append(ids, aws.ToString(instance.InstanceId))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("auto scaling group %q has no in-service instances", name)
+	}
+
+	return ids, nil
+}
+
+// pickAutoScalingGroupInstance returns the newest instance of the group,
+// or a random one when SSM_SSH_CONNECT_ASG_SELECT=random is set
+func pickAutoScalingGroupInstance(instances []ec2Types.Instance) ec2Types.Instance {
+	if os.Getenv("SSM_SSH_CONNECT_ASG_SELECT") == "random" {
+		return instances[rand.IntN(len(instances))]
+	}
+	return newestInstance(instances)
+}
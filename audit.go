@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// maxReasonLength is the longest reason StartSession accepts
+const maxReasonLength = 256
+
+// auditEntry is a line of the local audit log, which records every session and command the tool starts
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Profile    string    `json:"profile"`
+	Target     string    `json:"target"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	Region     string    `json:"region,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Document   string    `json:"document,omitempty"`
+	SessionID  string    `json:"session_id,omitempty"`
+	CommandID  string    `json:"command_id,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// appendAuditLog appends the entry as a JSON line to the audit log, under the lock pruneAuditLog takes
+// to replace it, so no entry goes into a file that is being replaced
+func appendAuditLog(path string, entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %v", err)
+	}
+	unlock, err := lock(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+// audit records the started session or command in StateDir/audit.log, a failure is only logged
+func audit(entry auditEntry) {
+	entry.Time = time.Now().UTC()
+	entry.Profile = profileLabel(&cfg)
+	entry.Target = cfg.InstanceName
+	entry.Reason = cfg.Reason
+	if err := appendAuditLog(cfg.StateDir+"/audit.log", entry); err != nil {
+		slog.Warn("failed to write audit log", "error", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"io"
+	"os"
+	"time"
+)
+
+// bannerShownEnv carries the instance ID whose banner a wrapping command showed to its ProxyCommand,
+// which then doesn't show it again
+const bannerShownEnv = "SSM_SSH_CONNECT_BANNER_SHOWN"
+
+// banner is what the connection banner tells about the instance
+type banner struct {
+	Account    string
+	InstanceID string
+	Name       string
+	AZ         string
+	Region     string
+	PrivateIP  string
+	LaunchTime time.Time
+}
+
+// instanceBanner looks up the banner details of the resolved instance, managed instances have no EC2 record
+// to take them from
+func instanceBanner() (banner, error) {
+	b := banner{InstanceID: cfg.InstanceID, AZ: cfg.InstanceAZ, Region: cfg.Region}
+	if cfg.Hybrid {
+		return b, nil
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	result, err := ec2Client().DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{cfg.InstanceID}})
+	if err != nil {
+		return b, fmt.Errorf("failed to describe instance %s: %v", cfg.InstanceID, err)
+	}
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			b.Account = aws.ToString(reservation.OwnerId)
+			b.Name = instanceName(instance)
+			b.PrivateIP = aws.ToString(instance.PrivateIpAddress)
+			b.LaunchTime = aws.ToTime(instance.LaunchTime)
+		}
+	}
+	return b, nil
+}
+
+// writeBanner writes the banner, leaving out what is not known
+func writeBanner(w io.Writer, b banner) {
+	fmt.Fprintf(w, "Connecting to %s", b.InstanceID)
+	if b.Name != "" {
+		fmt.Fprintf(w, " (%s)", b.Name)
+	}
+	if b.Account != "" {
+		fmt.Fprintf(w, " in account %s", b.Account)
+	}
+	fmt.Fprintln(w)
+	location := b.Region
+	if b.AZ != "" {
+		location = b.AZ
+	}
+	fmt.Fprintf(w, "  %s", location)
+	if b.PrivateIP != "" {
+		fmt.Fprintf(w, ", %s", b.PrivateIP)
+	}
+	if !b.LaunchTime.IsZero() {
+		fmt.Fprintf(w, ", launched %s", b.LaunchTime.Local().Format(time.DateTime))
+	}
+	fmt.Fprintln(w)
+}
+
+// showBanner writes the banner of the resolved instance to stderr, since stdout may be the ssh stream
+func showBanner() error {
+	if os.Getenv(bannerShownEnv) == cfg.InstanceID {
+		return nil
+	}
+	b, err := instanceBanner()
+	if err != nil {
+		return err
+	}
+	writeBanner(os.Stderr, b)
+	// wrapped ssh, scp and sftp run this tool again as their ProxyCommand
+	os.Setenv(bannerShownEnv, cfg.InstanceID)
+	return nil
+}
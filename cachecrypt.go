@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// encryptedCacheHeader starts cache files encrypted with the cache key, followed by the nonce and the sealed data
+const encryptedCacheHeader = "ssm-ssh-connect aes-256-gcm\n"
+
+// keychainService and keychainAccount name the cache key's entry in the OS keychain
+const (
+	keychainService = "ssm-ssh-connect"
+	keychainAccount = "cache-key"
+)
+
+// cacheKey returns the key encrypting the cache, created in the OS keychain on first use
+var cacheKey = sync.OnceValues(func() ([]byte, error) {
+	secret, found, err := keychainGet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the cache key from the keychain: %v", err)
+	}
+	if found {
+		key, err := hex.DecodeString(secret)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("the cache key in the keychain is not a 256-bit hex key")
+		}
+		return key, nil
+	}
+
+	slog.Info("creating the cache key in the keychain")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate the cache key: %v", err)
+	}
+	if err := keychainSet(hex.EncodeToString(key)); err != nil {
+		return nil, fmt.Errorf("failed to store the cache key in the keychain: %v", err)
+	}
+	return key, nil
+})
+
+// sealCache encrypts the cache data with the key
+func sealCache(key, data []byte) ([]byte, error) {
+	aead, err := cacheAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte(encryptedCacheHeader), nonce...)
+	return aead.Seal(sealed, nonce, data, []byte(encryptedCacheHeader)), nil
+}
+
+// openCache decrypts cache data sealed with the key
+func openCache(key, sealed []byte) ([]byte, error) {
+	aead, err := cacheAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, ok := bytes.CutPrefix(sealed, []byte(encryptedCacheHeader))
+	if !ok || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("not an encrypted cache file")
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(encryptedCacheHeader))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt cache file: %v", err)
+	}
+	return data, nil
+}
+
+func cacheAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedCache reports whether the data is an encrypted cache file
+func encryptedCache(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedCacheHeader))
+}
+
+// writeCacheFile writes a cache file, encrypted with --encrypt-cache
+func writeCacheFile(path string, data []byte, perm os.FileMode) error {
+	if cfg.EncryptCache {
+		key, err := cacheKey()
+		if err != nil {
+			return err
+		}
+		if data, err = sealCache(key, data); err != nil {
+			return fmt.Errorf("failed to encrypt cache file: %v", err)
+		}
+	}
+	// replaced as a whole, readers never see a partly written file
+	return replaceFile(path, data, perm)
+}
+
+// readCacheFile reads a cache file, decrypting it when encrypted. With --encrypt-cache a plaintext file
+// left from before is removed instead and reported missing, so it is written again encrypted.
+func readCacheFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !encryptedCache(data) {
+		if cfg.EncryptCache {
+			os.Remove(path)
+			return nil, fmt.Errorf("%s is not encrypted, removed it: %w", path, fs.ErrNotExist)
+		}
+		return data, nil
+	}
+	key, err := cacheKey()
+	if err != nil {
+		return nil, err
+	}
+	return openCache(key, data)
+}
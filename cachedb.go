@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cacheDBName is the file in the cache directory holding all resolved instances
+const cacheDBName = "instances.json"
+
+// cacheSchemaVersion is the format of the cache database. A change older versions can't read bumps it,
+// with a migration from the previous format appended to cacheMigrations.
+const cacheSchemaVersion = 1
+
+// cacheMigrations[i] upgrades a cache database of version i+1 to version i+2
+var cacheMigrations = []func(db *cacheDB){}
+
+// cacheDB holds the resolved instances, keyed by cacheEntryKey
+type cacheDB struct {
+	Version int                   `json:"version"`
+	Entries map[string]cacheEntry `json:"entries"`
+	// PushedKeys records the keys pushed with EC2 Instance Connect while they are authorized
+	PushedKeys pushedKeys `json:"pushed_keys,omitempty"`
+	// Plugin is the session-manager-plugin version last asked for
+	Plugin *pluginInfo `json:"plugin,omitempty"`
+}
+
+func newCacheDB() cacheDB {
+	return cacheDB{Version: cacheSchemaVersion, Entries: map[string]cacheEntry{}, PushedKeys: pushedKeys{}}
+}
+
+// migrate upgrades the database to cacheSchemaVersion. One written by a newer version can't be read,
+// since its entries may mean something else by now.
+func (db *cacheDB) migrate() error {
+	if db.Version == 0 {
+		// written before the format was versioned
+		db.Version = 1
+	}
+	if db.Version > cacheSchemaVersion {
+		return fmt.Errorf("cache version %d is newer than the supported version %d", db.Version, cacheSchemaVersion)
+	}
+	for ; db.Version < cacheSchemaVersion; db.Version++ {
+		cacheMigrations[db.Version-1](db)
+	}
+	if db.Entries == nil {
+		db.Entries = map[string]cacheEntry{}
+	}
+	if db.PushedKeys == nil {
+		db.PushedKeys = pushedKeys{}
+	}
+	return nil
+}
+
+// cacheEntry is a resolved instance, the cached fields of Config, with when it was resolved.
+// NotFound entries remember a target that was not found and hold no instance.
+type cacheEntry struct {
+	Saved    time.Time       `json:"saved"`
+	Profile  string          `json:"profile,omitempty"`
+	NotFound bool            `json:"not_found,omitempty"`
+	Instance json.RawMessage `json:"instance,omitempty"`
+}
+
+func cacheDBPath(dir string) string {
+	return filepath.Join(dir, cacheDBName)
+}
+
+// cacheEntryKey identifies the cache entry of the target, resolved for the user with the selection options
+func cacheEntryKey(cfg *Config) string {
+	return fmt.Sprintf("%s-%s-%s%s", profileLabel(cfg), fileSafeName(cfg.InstanceName), cfg.InstanceUser, selectorSuffix(cfg))
+}
+
+// readCacheDB reads the cache database, which is empty when there is none yet. It is replaced as a
+// whole on every change, so reading needs no lock.
+func readCacheDB(dir string) (cacheDB, error) {
+	db := newCacheDB()
+	data, err := readCacheFile(cacheDBPath(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return db, err
+	}
+	db.Version = 0
+	if err := json.Unmarshal(data, &db); err != nil {
+		return newCacheDB(), fmt.Errorf("failed to parse %s: %v", cacheDBPath(dir), err)
+	}
+	if err := db.migrate(); err != nil {
+		return newCacheDB(), fmt.Errorf("%s: %v", cacheDBPath(dir), err)
+	}
+	return db, nil
+}
+
+// updateCacheDB changes the cache database under its lock, so concurrent invocations don't lose each
+// other's entries. An unreadable database, or one of a newer version, is started afresh: it only holds
+// what can be looked up again.
+func updateCacheDB(dir string, change func(db *cacheDB)) error {
+	path := cacheDBPath(dir)
+	unlock, err := lock(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db, err := readCacheDB(dir)
+	if err != nil {
+		slog.Warn("discarding unreadable cache", "error", err)
+	}
+	change(&db)
+	data, err := json.Marshal(db)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache: %v", err)
+	}
+	return writeCacheFile(path, data, 0600)
+}
+
+// dropCache removes the target's cache entry
+func dropCache(cfg *Config) error {
+	return updateCacheDB(cfg.CacheDir, func(db *cacheDB) {
+		delete(db.Entries, cacheEntryKey(cfg))
+	})
+}
+
+// importCacheFiles moves the per-target cache files of earlier versions into the cache database.
+// Other JSON files in the cache directory are left alone.
+func importCacheFiles(dir string) error {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	legacy := map[string][]byte{}
+	for _, path := range paths {
+		if name := filepath.Base(path); name == cacheDBName || strings.HasSuffix(name, "-credentials.json") {
+			continue
+		}
+		if data, err := readCacheFile(path); err == nil && legacyCacheFile(filepath.Base(path), data) {
+			legacy[path] = data
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	return updateCacheDB(dir, func(db *cacheDB) {
+		for path, data := range legacy {
+			info, err := os.Stat(path)
+			key := strings.TrimSuffix(filepath.Base(path), ".json")
+			if _, ok := db.Entries[key]; !ok && err == nil {
+				db.Entries[key] = cacheEntry{Saved: info.ModTime(), Instance: data}
+			}
+			os.Remove(path)
+		}
+	})
+}
+
+// legacyCacheFile reports whether a file is a cache file of an earlier version: named
+// <profile>-<name>-<user>.json and holding a resolved instance
+func legacyCacheFile(name string, data []byte) bool {
+	if strings.Count(strings.TrimSuffix(name, ".json"), "-") < 2 {
+		return false
+	}
+	var instance Config
+	if json.Unmarshal(data, &instance) != nil {
+		return false
+	}
+	return strings.HasPrefix(instance.InstanceID, "i-") || strings.HasPrefix(instance.InstanceID, "mi-")
+}
+
+// cacheRow is a cache entry as the cache show command prints it
+type cacheRow struct {
+	Profile    string    `json:"profile,omitempty"`
+	Name       string    `json:"name"`
+	InstanceID string    `json:"instance_id"`
+	Region     string    `json:"region"`
+	Saved      time.Time `json:"saved"`
+	Expired    bool      `json:"expired"`
+}
+
+// cacheRows returns the entries of the cache database sorted by name and profile, those older than
+// the TTL marked expired
+func cacheRows(db cacheDB, ttl time.Duration, now time.Time) []cacheRow {
+	var rows []cacheRow
+	for _, entry := range db.Entries {
+		var instance Config
+		if err := json.Unmarshal(entry.Instance, &instance); err != nil {
+			continue
+		}
+		rows = append(rows, cacheRow{
+			Profile:    entry.Profile,
+			Name:       instance.CachedName,
+			InstanceID: instance.InstanceID,
+			Region:     instance.Region,
+			Saved:      entry.Saved,
+			Expired:    now.Sub(entry.Saved) > ttl,
+		})
+	}
+	slices.SortFunc(rows, func(a, b cacheRow) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Profile, b.Profile), a.Saved.Compare(b.Saved))
+	})
+	return rows
+}
+
+// writeCacheRows writes the cache entries as a table or as JSON
+func writeCacheRows(w io.Writer, rows []cacheRow, output string, now time.Time) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROFILE\tINSTANCE ID\tREGION\tAGE")
+	for _, row := range rows {
+		age := now.Sub(row.Saved).Truncate(time.Second).String()
+		if row.Expired {
+			age += " (expired)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", row.Name, row.Profile, row.InstanceID, row.Region, age)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"io"
+	"time"
+)
+
+// warmInstances returns the running instances of the profile that connecting could resolve to, with the
+// same selection options (--exclude, --vpc, --subnet, --platform) and --tag
+func warmInstances() ([]ec2Types.Instance, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []ec2Types.Filter{
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"running"},
+			},
+		},
+	}
+	if cfg.VpcID != "" {
+		input.Filters = append(input.Filters, ec2Types.Filter{Name: aws.String("vpc-id"), Values: []string{cfg.VpcID}})
+	}
+	if cfg.SubnetID != "" {
+		input.Filters = append(input.Filters, ec2Types.Filter{Name: aws.String("subnet-id"), Values: []string{cfg.SubnetID}})
+	}
+
+	var instances []ec2Types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client(), input)
+	for paginator.HasMorePages() {
+		ctx, cancel := apiContext()
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %v", err)
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	instances = excludeInstances(instances, cfg.Excludes)
+	instances = filterPlatform(instances, cfg.PlatformOnly)
+	if len(cfg.Tags) == 0 {
+		return instances, nil
+	}
+	var tagged []ec2Types.Instance
+	for _, instance := range instances {
+		if cfg.Tags.matches(instance) {
+			tagged = append(tagged, instance)
+		}
+	}
+	return tagged, nil
+}
+
+// warmEntries returns the cache entries of the instances, keyed as connecting by Name tag or instance ID
+// with the options of base would look them up, for the user mapped to each. A name several instances
+// share is left out, connecting asks which of them to use, and so is a target no user is mapped for,
+// since no connection would look its entry up. It returns the entries and how many targets had no user.
+func warmEntries(instances []ec2Types.Instance, base Config, user func(name string) string, now time.Time) (map[string]cacheEntry, int, error) {
+	named := map[string]int{}
+	for _, instance := range instances {
+		named[instanceName(instance)]++
+	}
+
+	entries := map[string]cacheEntry{}
+	unmapped := 0
+	for _, instance := range instances {
+		targets := []string{aws.ToString(instance.InstanceId)}
+		if name := instanceName(instance); name != "" && named[name] == 1 {
+			targets = append(targets, name)
+		}
+		for _, target := range targets {
+			if user(target) == "" {
+				unmapped++
+				continue
+			}
+			c := base
+			c.InstanceName = target
+			c.InstanceUser = user(target)
+			c.CachedName = target
+			c.InstanceID = aws.ToString(instance.InstanceId)
+			c.InstanceAZ = aws.ToString(instance.Placement.AvailabilityZone)
+			c.Region = c.InstanceAZ[:len(c.InstanceAZ)-1]
+			c.Platform = platformOf(instance)
+			c.Hybrid = false
+
+			data, err := json.Marshal(&c)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to marshal config: %v", err)
+			}
+			entries[cacheEntryKey(&c)] = cacheEntry{Saved: now, Profile: profileLabel(&c), Instance: data}
+		}
+	}
+	return entries, unmapped, nil
+}
+
+// warmCache caches all running instances of the profile, so the first connection to each is as fast as the next
+func warmCache(w io.Writer, user func(name string) string) error {
+	if cfg.CacheTTL <= 0 {
+		return fmt.Errorf("the cache is disabled, --cache-ttl is 0")
+	}
+	instances, err := warmInstances()
+	if err != nil {
+		return err
+	}
+	entries, unmapped, err := warmEntries(instances, cfg, user, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := updateCacheDB(cfg.CacheDir, func(db *cacheDB) {
+		for key, entry := range entries {
+			db.Entries[key] = entry
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to write cache: %v", err)
+	}
+	fmt.Fprintf(w, "Cached %d instances under %d names and IDs\n", len(instances), len(entries))
+	if unmapped > 0 {
+		fmt.Fprintf(w, "Skipped %d names and IDs without a user, give one or map it in the config file\n", unmapped)
+	}
+	return nil
+}
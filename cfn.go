@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"strings"
+)
+
+// getStackInstanceIDs returns IDs of the EC2 instances created by a CloudFormation stack,
+// target is given as <stack-name>[/<logical-id>]
+func getStackInstanceIDs(target string) ([]string, error) {
+	stack, logicalID, _ := strings.Cut(target, "/")
+	if stack == "" {
+		return nil, fmt.Errorf("invalid CloudFormation target %q, expected cfn:<stack-name>[/<logical-id>]", target)
+	}
+
+	input := &cloudformation.DescribeStackResourcesInput{
+		StackName: aws.String(stack),
+	}
+	if logicalID != "" {
+		input.LogicalResourceId = aws.String(logicalID)
+	}
+
+	client := cloudformation.NewFromConfig(awsConfig)
+	ctx, cancel := apiContext()
+	defer cancel()
+	result, err := client.DescribeStackResources(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe stack resources: %v", err)
+	}
+
+	var ids []string
+	for _, resource := range result.StackResources {
+		if aws.ToString(resource.ResourceType) == "AWS::EC2::Instance" && aws.ToString(resource.PhysicalResourceId) != "" {
+			ids = append(ids, aws.ToString(resource.PhysicalResourceId))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("stack %q has no EC2 instance resources", target)
+	}
+
+	return ids, nil
+}
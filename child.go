@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// childStopGrace is how long the session's process gets to exit after a relayed termination signal before it is killed
+const childStopGrace = 5 * time.Second
+
+// errSessionStopped ends a session whose process was stopped by a termination signal
+var errSessionStopped = errors.New("session stopped by signal")
+
+// child is the running process of the session, the session-manager-plugin or the wrapped ssh,
+// which shutdown relays signals to instead of exiting under it
+var child struct {
+	sync.Mutex
+	process *os.Process
+	// stopping is set once a termination signal was relayed, so no session is started again
+	stopping bool
+	// signal is the termination signal that stopped the session
+	signal os.Signal
+}
+
+// trackChild makes the started process the one signals are relayed to, until untrack is called
+func trackChild(process *os.Process) (untrack func()) {
+	child.Lock()
+	defer child.Unlock()
+	child.process = process
+	return func() {
+		child.Lock()
+		defer child.Unlock()
+		if child.process == process {
+			child.process = nil
+		}
+	}
+}
+
+// relaySignal forwards the signal to the session's process and reports whether one is running. After a termination
+// signal the process is killed unless it exits within childStopGrace, or right away on a second one. Processes that
+// can't be signalled, as on Windows, are killed.
+func relaySignal(s os.Signal, terminate bool) bool {
+	child.Lock()
+	defer child.Unlock()
+	process := child.process
+	if process == nil {
+		return false
+	}
+	if !terminate {
+		process.Signal(s)
+		return true
+	}
+
+	if child.stopping {
+		slog.Warn("second shutdown signal, killing the session's process", "pid", process.Pid)
+		process.Kill()
+		return true
+	}
+	child.stopping = true
+	child.signal = s
+	if err := process.Signal(s); err != nil {
+		slog.Warn("failed to relay the signal, killing the session's process", "pid", process.Pid, "error", err)
+		process.Kill()
+		return true
+	}
+	time.AfterFunc(childStopGrace, func() { process.Kill() })
+	return true
+}
+
+// stopping reports whether a termination signal was relayed to the session's process
+func stopping() bool {
+	child.Lock()
+	defer child.Unlock()
+	return child.stopping
+}
+
+// signalExitCode is the exit code of a process ended by the signal, as shells report it
+func signalExitCode(s os.Signal) int {
+	if sig, ok := s.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 1
+}
+
+// exitCode is the exit code for the error that ended the session: the plugin's or ssh's own exit code,
+// that of the signal which stopped the session, or else 1
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errSessionStopped):
+		child.Lock()
+		defer child.Unlock()
+		return signalExitCode(child.signal)
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0:
+		return exitErr.ExitCode()
+	}
+	return 1
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// cliCommand is a subcommand with its arguments and a one-line description for the usage message
+type cliCommand struct {
+	name, args, help string
+}
+
+// cliCommands lists the subcommands. Without one, the arguments are those of connect,
+// which keeps existing ProxyCommand lines working.
+var cliCommands = []cliCommand{
+	{"connect", "[aws-profile] <instance-name> [instance-user]", "connect stdin/stdout to sshd (as ProxyCommand), or open a shell when run in a terminal"},
+	{"list", "[--output json] [aws-profile]", "list instances with their SSM agent status"},
+	{"resolve", "[aws-profile] <instance-name>", "print the instance the name resolves to, with its availability zone and region, as JSON"},
+	{"ssh-config", "[--tag tag:Key=Value ...] [aws-profile]", "print ssh_config Host blocks with the ProxyCommand for the running instances, e.g. to Include from ~/.ssh/config"},
+	{"tui", "[aws-profile]", "browse the instances full-screen, filter by name or tag as you type and open a shell with Enter"},
+	{"cp", "[aws-profile] <instance-name> [instance-user] -- <scp-args with :remote-path>", "copy files with scp"},
+	{"sftp", "[aws-profile] <instance-name> [instance-user] [-- <sftp-args>]", "open an sftp session"},
+	{"forward", "-L localPort:host:remotePort [-L ...] [aws-profile] <instance-name> [instance-user]", "forward local ports through the instance, several forwards need the instance user"},
+	{"db", "[--db-client client] [aws-profile] <instance-name> <db-endpoint[:port]> [-- <client-args>]", "run psql, mysql or redis-cli against a database reached through the instance"},
+	{"kube", "[--kube-port port] [aws-profile] <instance-name> <eks-cluster-name|endpoint>", "forward a local port to a private EKS API endpoint"},
+	{"rdp", "[--rdp-port port] [--launch] [aws-profile] <instance-name>", "forward a local port to the RDP port of a Windows instance"},
+	{"run", "[aws-profile] <instance-name> -- <command>", "run a single command with Run Command"},
+	{"shell", "[aws-profile] <instance-name>", "open a shell without ssh"},
+	{"socks", "[-D port] [aws-profile] <instance-name> [instance-user]", "open a SOCKS5 proxy into the instance's network"},
+	{"cache", "show [--output json] | warm [--tag tag:Key=Value ...] [aws-profile] [instance-user]", "list the cached instances with their age, or cache all running instances ahead of the first connection"},
+	{"daemon", "", "keep credentials and resolved instances in memory and start the sessions of later connections, which then skip most of the setup"},
+	{"sessions", "[--output json] [aws-profile] | terminate [aws-profile] [session-id ...|all]", "list your active Session Manager sessions, or terminate them, e.g. those left behind by a crash or a laptop that went to sleep; without IDs, pick one on the terminal"},
+	{"status", "[--output json]", "show the daemon's active sessions, cache hit rate, credential expiry times and connections per host"},
+	{"version", "", "print the version, commit and build date, and the session-manager-plugin version"},
+	{"install", "[aws-profile] [host-patterns]", "add a block to ~/.ssh/config that connects to the hosts (default i-*,mi-*) through this tool"},
+	{"uninstall", "", "remove the block install added from ~/.ssh/config"},
+	{"self-update", "", "replace this binary with a newer release, after checking its checksum"},
+	{"completion", "bash|zsh|fish", "print the shell completion script, e.g. source <(ssm-ssh-connect completion bash)"},
+	{"help", "[command]", "show usage, of one command or of all"},
+}
+
+// findCommand returns the subcommand of the name
+func findCommand(name string) (cliCommand, bool) {
+	for _, c := range cliCommands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+// usage writes the usage message of the command, or of all commands when name is empty
+func usage(w io.Writer, program, name string) {
+	if c, ok := findCommand(name); ok {
+		fmt.Fprintf(w, "Usage: %s\n\n%s\n\nFlags:\n", strings.TrimSpace(program+" [flags] "+c.name+" "+c.args), c.help)
+	} else {
+		fmt.Fprintf(w, "Usage: %s [flags] <command> [flags] <arguments>\n", program)
+		fmt.Fprintf(w, "       %s [flags] [aws-profile] <instance-name> [instance-user]  (same as connect)\n\nCommands:\n", program)
+		for _, c := range cliCommands {
+			fmt.Fprintf(w, "  %-8s %s\n           %s\n", c.name, c.args, c.help)
+		}
+		fmt.Fprintln(w, "\nWithout a profile (or with -), SSM_SSH_CONNECT_PROFILE or else the default credential chain is used, e.g. AWS_WEB_IDENTITY_TOKEN_FILE.")
+		fmt.Fprintln(w, "Every flag can also be set in the environment as SSM_SSH_CONNECT_<FLAG>, e.g. SSM_SSH_CONNECT_CACHE_TTL=1h.\n\nFlags:")
+	}
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+}
+
+// flagGiven reports whether the flag was set on the command line or in the environment
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// flagEnv returns the environment variable that sets the flag, e.g. SSM_SSH_CONNECT_CACHE_TTL for --cache-ttl
+func flagEnv(name string) string {
+	return "SSM_SSH_CONNECT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// setFlagsFromEnv sets the flags that are given in the environment, before the command line is parsed.
+// Shorthand flags have none, repeatable flags take a single value.
+func setFlagsFromEnv(flags *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) == 1 || err != nil {
+			return
+		}
+		value, ok := lookupEnv(flagEnv(f.Name))
+		if !ok || value == "" {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s %q: %v", flagEnv(f.Name), value, setErr)
+		}
+	})
+	return err
+}
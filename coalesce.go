@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+)
+
+// resolveLockPath returns the lock file serializing lookups of the target across processes: rsync or Ansible
+// open many channels at once, and all but the first wait for its lookup to be cached instead of repeating it.
+// Key pushes are shared the same way on pushLockPath. Lock files are touched when taken, and
+// prune removes those of targets not looked up for a while.
+func resolveLockPath(cfg *Config) string {
+	return fmt.Sprintf("%s/resolve-%s.lock", cfg.StateDir, fileSafeName(cacheEntryKey(cfg)))
+}
+
+// pushLockPath returns the lock file serializing key pushes to the instance's user across processes,
+// touched and pruned like the lookup locks
+func pushLockPath(cfg *Config) string {
+	return fmt.Sprintf("%s/push-%s-%s.lock", cfg.StateDir, cfg.InstanceID, fileSafeName(cfg.InstanceUser))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// completionScripts hook the shells' completion up to the __complete command, which prints the candidates
+// for the words typed so far, the last one being the word under the cursor
+var completionScripts = map[string]string{
+	"bash": `_ssm_ssh_connect() {
+    local IFS=$'\n'
+    COMPREPLY=($(compgen -W "$(ssm-ssh-connect __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)" -- "${COMP_WORDS[COMP_CWORD]}"))
+}
+complete -o default -F _ssm_ssh_connect ssm-ssh-connect
+`,
+	"zsh": `#compdef ssm-ssh-connect
+_ssm_ssh_connect() {
+    local -a candidates
+    candidates=("${(@f)$(ssm-ssh-connect __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    compadd -a candidates
+}
+compdef _ssm_ssh_connect ssm-ssh-connect
+`,
+	"fish": `complete -c ssm-ssh-connect -f -a '(ssm-ssh-connect __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+`,
+}
+
+// completionScript returns the completion script of the shell
+func completionScript(shell string) (string, error) {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return "", fmt.Errorf("no completion for shell %q, expected bash, zsh or fish", shell)
+	}
+	return script, nil
+}
+
+// completions returns the candidates for the last of the words: flags, or commands, AWS profile names,
+// aliases and instance names from the cache. The shell filters them by what has been typed.
+func completions(words []string, awsConfigFiles []string, configDir, cacheDir string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current, previous := words[len(words)-1], words[:len(words)-1]
+	if strings.HasPrefix(current, "-") {
+		var flags []string
+		flag.VisitAll(func(f *flag.Flag) {
+			if len(f.Name) == 1 {
+				flags = append(flags, "-"+f.Name)
+			} else {
+				flags = append(flags, "--"+f.Name)
+			}
+		})
+		return flags
+	}
+
+	// count the positional arguments before the cursor, skipping flags and their values
+	var positional []string
+	for i := 0; i < len(previous); i++ {
+		word := previous[i]
+		if word == "--" {
+			// arguments of the remote command or client
+			return nil
+		}
+		if !strings.HasPrefix(word, "-") {
+			positional = append(positional, word)
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(word, "-"), "=")
+		if f := flag.Lookup(name); f != nil && !hasValue && !isBoolFlag(f) {
+			if i == len(previous)-1 {
+				// the cursor is on the flag's value
+				return nil
+			}
+			i++
+		}
+	}
+
+	var candidates []string
+	if len(positional) == 0 {
+		for _, c := range cliCommands {
+			candidates = append(candidates, c.name)
+		}
+	}
+	if len(positional) == 1 && positional[0] == "help" {
+		for _, c := range cliCommands {
+			candidates = append(candidates, c.name)
+		}
+		return candidates
+	}
+	candidates = append(candidates, awsProfiles(awsConfigFiles)...)
+	if fileConfig, err := loadConfigFile(configDir + "/config.yaml"); err == nil {
+		for alias := range fileConfig.Aliases {
+			candidates = append(candidates, alias)
+		}
+	}
+	return append(candidates, cachedNames(cacheDir)...)
+}
+
+// isBoolFlag reports whether the flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// awsConfigFiles returns the AWS config and shared credentials files
+func awsConfigFiles() []string {
+	home := homeDir()
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = home + "/.aws/config"
+	}
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = home + "/.aws/credentials"
+	}
+	return []string{configFile, credentialsFile}
+}
+
+// awsProfiles returns the profile names defined in the AWS config and credentials files
+func awsProfiles(files []string) []string {
+	var profiles []string
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+				continue
+			}
+			section := strings.TrimSpace(line[1 : len(line)-1])
+			if kind, name, ok := strings.Cut(section, " "); ok {
+				// the config file names profiles [profile name], skip [sso-session name] and the like
+				if kind != "profile" {
+					continue
+				}
+				section = strings.TrimSpace(name)
+			}
+			if !slices.Contains(profiles, section) {
+				profiles = append(profiles, section)
+			}
+		}
+		file.Close()
+	}
+	return profiles
+}
+
+// cachedNames returns the instance names of the cache entries, which are the names used before.
+// An encrypted cache is left alone, completion doesn't ask the keychain for its key.
+func cachedNames(cacheDir string) []string {
+	data, err := os.ReadFile(cacheDBPath(cacheDir))
+	if err != nil || encryptedCache(data) {
+		return nil
+	}
+	var db cacheDB
+	if json.Unmarshal(data, &db) != nil || db.migrate() != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range db.Entries {
+		var instance struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(entry.Instance, &instance) == nil && instance.Name != "" && !slices.Contains(names, instance.Name) {
+			names = append(names, instance.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
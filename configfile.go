@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"log/slog"
+	"os"
+	osuser "os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// FileConfig holds defaults read from ConfigDir/config.yaml; command line flags and environment variables take precedence
+type FileConfig struct {
+	// Profile is used when no profile is given and AWS_PROFILE is not set
+	Profile string `yaml:"profile"`
+	Region  string `yaml:"region"`
+	// User is the OS user of instances no host entry maps
+	User string `yaml:"user"`
+
+	Identity string   `yaml:"identity"`
+	KeyFiles []string `yaml:"key_files"`
+	PushKeys []string `yaml:"push_keys"`
+
+	Keepalive   time.Duration `yaml:"keepalive"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// Document replaces AWS-StartSSHSession, with its Parameters
+	Document   string              `yaml:"document"`
+	Parameters map[string][]string `yaml:"parameters"`
+
+	// Banner shows the instance details before connecting
+	Banner bool `yaml:"banner"`
+	// EncryptCache encrypts cached instances and credentials with a key kept in the OS keychain
+	EncryptCache bool `yaml:"encrypt_cache"`
+	// PruneAfter is how old cache and log entries get before they are pruned, a pointer since 0 disables it
+	PruneAfter *time.Duration `yaml:"prune_after"`
+	// MaxStorageMB caps the cache and state directories together, 0 disables the cap
+	MaxStorageMB *int `yaml:"max_storage_mb"`
+	// SharedCache is an s3://bucket/prefix the team shares resolved instances in
+	SharedCache string `yaml:"shared_cache"`
+	// Resolver is where targets are looked up, ec2 or ssm
+	Resolver string `yaml:"resolver"`
+	// AllRegions searches all enabled regions for targets not found in the profile's region
+	AllRegions bool `yaml:"all_regions"`
+
+	// CacheTTL is a pointer since 0 disables the cache
+	CacheTTL *time.Duration `yaml:"cache_ttl"`
+	// Retries is how often AWS API calls failing with a transient error are retried, 0 disables retries
+	Retries *int `yaml:"retries"`
+	// APITimeout bounds each AWS API call and ConnectTimeout the whole way to the session, 0 waits forever
+	APITimeout     *time.Duration `yaml:"api_timeout"`
+	ConnectTimeout *time.Duration `yaml:"connect_timeout"`
+	PluginPath     string         `yaml:"plugin_path"`
+	LogLevel       string         `yaml:"log_level"`
+
+	// ConfirmTags guard instances: a session to an instance carrying one of the tags (tag:Key=Value)
+	// starts only after its name is typed on the terminal
+	ConfirmTags tagFilters `yaml:"confirm_tags"`
+
+	// Hosts map instance-name patterns to an OS user and identity file, the first match wins
+	Hosts []HostConfig `yaml:"hosts"`
+	// Aliases are short names standing for an instance name, with its profile and user
+	Aliases map[string]AliasConfig `yaml:"aliases"`
+	// Profiles map AWS profile names ("default" for the default credential chain) to their settings
+	Profiles map[string]ProfileConfig `yaml:"profiles"`
+}
+
+// HostConfig holds the settings for instances whose name matches the Match glob
+type HostConfig struct {
+	Match    string `yaml:"match"`
+	User     string `yaml:"user"`
+	Identity string `yaml:"identity"`
+}
+
+// AliasConfig is what an alias stands for, only Name is required
+type AliasConfig struct {
+	Profile string `yaml:"profile"`
+	Name    string `yaml:"name"`
+	User    string `yaml:"user"`
+}
+
+// apply replaces the alias in cfg with the instance name, and sets the profile and user
+// where the command line gives none
+func (a AliasConfig) apply(cfg *Config, profileGiven bool) {
+	cfg.InstanceName = a.Name
+	if !profileGiven && a.Profile != "" {
+		cfg.AwsProfile = a.Profile
+	}
+	if (cfg.InstanceUser == "" || cfg.InstanceUser == "-") && a.User != "" {
+		cfg.InstanceUser = a.User
+	}
+}
+
+// ProfileConfig holds the settings for instances reached with an AWS profile
+type ProfileConfig struct {
+	// User is the OS user of the profile's instances no host entry maps
+	User string `yaml:"user"`
+	// SharedCache is the profile's shared cache, prefixes are per account
+	SharedCache string `yaml:"shared_cache"`
+	// Resolver is where targets of the profile are looked up, e.g. ssm in accounts granting no EC2 permissions
+	Resolver string `yaml:"resolver"`
+}
+
+// host returns the settings of the first host entry matching the instance name
+func (f FileConfig) host(name string) HostConfig {
+	for _, host := range f.Hosts {
+		if ok, _ := path.Match(host.Match, name); ok {
+			return host
+		}
+	}
+	return HostConfig{}
+}
+
+// user returns the OS user for the instance name reached with the profile: that of the first matching
+// host entry, else the profile's, else the default
+func (f FileConfig) user(name, profile string) string {
+	if user := f.host(name).User; user != "" {
+		return user
+	}
+	if user := f.Profiles[profile].User; user != "" {
+		return user
+	}
+	return f.User
+}
+
+// localUser reports whether the user is the local one, which ssh passes as %r when ssh_config names no
+// User. It is rarely the instance's, so a user mapped in the config file takes its place.
+func localUser(name string) bool {
+	current, err := osuser.Current()
+	if err != nil {
+		return false
+	}
+	// Windows reports DOMAIN\user, ssh passes the user alone
+	_, local, _ := strings.Cut(current.Username, `\`)
+	return name != "" && (name == current.Username || name == local)
+}
+
+// loadConfigFile reads the config file, a missing file is not an error
+func loadConfigFile(configPath string) (FileConfig, error) {
+	var fileConfig FileConfig
+
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileConfig, nil
+	}
+	if err != nil {
+		return fileConfig, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if err := yaml.Unmarshal(data, &fileConfig); err != nil {
+		return fileConfig, fmt.Errorf("failed to parse config file %s: %v", configPath, err)
+	}
+	if fileConfig.CacheTTL != nil && *fileConfig.CacheTTL < 0 {
+		return fileConfig, fmt.Errorf("negative cache_ttl in config file %s", configPath)
+	}
+	if fileConfig.Retries != nil && *fileConfig.Retries < 0 {
+		return fileConfig, fmt.Errorf("negative retries in config file %s", configPath)
+	}
+	if fileConfig.APITimeout != nil && *fileConfig.APITimeout < 0 {
+		return fileConfig, fmt.Errorf("negative api_timeout in config file %s", configPath)
+	}
+	if fileConfig.ConnectTimeout != nil && *fileConfig.ConnectTimeout < 0 {
+		return fileConfig, fmt.Errorf("negative connect_timeout in config file %s", configPath)
+	}
+	if fileConfig.PruneAfter != nil && *fileConfig.PruneAfter < 0 {
+		return fileConfig, fmt.Errorf("negative prune_after in config file %s", configPath)
+	}
+	if fileConfig.MaxStorageMB != nil && *fileConfig.MaxStorageMB < 0 {
+		return fileConfig, fmt.Errorf("negative max_storage_mb in config file %s", configPath)
+	}
+	if fileConfig.LogLevel != "" {
+		if _, err := parseLogLevel(fileConfig.LogLevel); err != nil {
+			return fileConfig, fmt.Errorf("%v in config file %s", err, configPath)
+		}
+	}
+	for _, host := range fileConfig.Hosts {
+		if _, err := path.Match(host.Match, ""); err != nil || host.Match == "" {
+			return fileConfig, fmt.Errorf("invalid host pattern %q in config file %s", host.Match, configPath)
+		}
+	}
+	for alias, target := range fileConfig.Aliases {
+		if target.Name == "" {
+			return fileConfig, fmt.Errorf("alias %q has no name in config file %s", alias, configPath)
+		}
+	}
+	return fileConfig, nil
+}
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid log level %q", level)
+	}
+	return l, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"io"
+	"os"
+	"strings"
+)
+
+// confirmedEnv carries the instance ID confirmed by a wrapping command to its ProxyCommand, which then
+// doesn't ask again
+const confirmedEnv = "SSM_SSH_CONNECT_CONFIRMED"
+
+// instanceTags returns the tags of the resolved instance, looked up fresh since cache entries hold none
+func instanceTags() (map[string]string, error) {
+	tags := map[string]string{}
+	if cfg.Hybrid {
+		ctx, cancel := apiContext()
+		defer cancel()
+		result, err := ssmClient().ListTagsForResource(ctx, &ssm.ListTagsForResourceInput{
+			ResourceType: ssmTypes.ResourceTypeForTaggingManagedInstance,
+			ResourceId:   aws.String(cfg.InstanceID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %v", cfg.InstanceID, err)
+		}
+		for _, tag := range result.TagList {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		return tags, nil
+	}
+
+	instances, err := describeInstances(ec2Client(), &ec2.DescribeInstancesInput{InstanceIds: []string{cfg.InstanceID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instance %s: %v", cfg.InstanceID, err)
+	}
+	for _, instance := range instances {
+		for _, tag := range instance.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return tags, nil
+}
+
+// confirmSession asks on the controlling terminal to type the instance's name (or ID) before a session
+// to an instance carrying one of the guard tags starts. Without a terminal there is no session.
+func confirmSession(guard tagFilters) error {
+	if len(guard) == 0 || os.Getenv(confirmedEnv) == cfg.InstanceID {
+		return nil
+	}
+	tags, err := instanceTags()
+	if err != nil {
+		return err
+	}
+	if !guard.matchesTags(tags) {
+		return nil
+	}
+
+	phrase := tags["Name"]
+	if phrase == "" {
+		phrase = cfg.InstanceID
+	}
+	tty, err := openTTY()
+	if err != nil {
+		return fmt.Errorf("%s is a guarded instance and there is no terminal to confirm the session on", phrase)
+	}
+	defer tty.Close()
+	if err := confirmPhrase(tty, tty, fmt.Sprintf("%s (%s) is tagged %s.", phrase, cfg.InstanceID, guard.String()), phrase); err != nil {
+		return err
+	}
+	// wrapped ssh, scp and sftp run this tool again as their ProxyCommand
+	os.Setenv(confirmedEnv, cfg.InstanceID)
+	return nil
+}
+
+// confirmPhrase writes the warning and asks to type the phrase, anything else aborts
+func confirmPhrase(r io.Reader, w io.Writer, warning, phrase string) error {
+	fmt.Fprintf(w, "%s\nType %q to connect: ", warning, phrase)
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("failed to read confirmation: %v", err)
+	}
+	if strings.TrimSpace(line) != phrase {
+		return fmt.Errorf("confirmation did not match, not connecting")
+	}
+	return nil
+}
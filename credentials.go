@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// credentialsExpiryWindow makes cached credentials expire a bit early, so they don't lapse mid-connection
+const credentialsExpiryWindow = 5 * time.Minute
+
+// loadAWSConfig loads the profile's configuration. Profiles with an mfa_serial prompt for the
+// token code on the terminal. Role credentials (including role chains through source_profile
+// and --role-arn on top of the profile) are cached on disk, so that every SSH channel doesn't
+// prompt again or pay for several sequential AssumeRole round-trips.
+func loadAWSConfig() error {
+	options := []func(*config.LoadOptions) error{
+		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.TokenProvider = mfaTokenProvider
+		}),
+	}
+	// without a profile the default credential chain applies (environment, web identity, ...)
+	if cfg.AwsProfile != "" {
+		options = append(options, config.WithSharedConfigProfile(cfg.AwsProfile))
+	}
+	if cfg.RegionFlag != "" {
+		options = append(options, config.WithRegion(cfg.RegionFlag))
+	}
+	if cfg.FIPS {
+		options = append(options, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	options = append(options, config.WithRetryer(apiRetryer(cfg.Retries)))
+
+	var err error
+	ctx, cancel := apiContext()
+	defer cancel()
+	awsConfig, err = config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return err
+	}
+
+	profile, err := config.LoadSharedConfigProfile(ctx, profileLabel(&cfg))
+	if err == nil && (profile.RoleARN != "" || profile.MFASerial != "") {
+		awsConfig.Credentials = aws.NewCredentialsCache(&fileCredentialsProvider{
+			path:     credentialsCacheFile(&cfg, ""),
+			provider: awsConfig.Credentials,
+		})
+	}
+
+	if cfg.RoleARN != "" {
+		slog.Info("assuming role", "role", cfg.RoleARN)
+		awsConfig.Credentials = aws.NewCredentialsCache(&fileCredentialsProvider{
+			path: credentialsCacheFile(&cfg, cfg.RoleARN),
+			provider: stscreds.NewAssumeRoleProvider(
+				sts.NewFromConfig(awsConfig),
+				cfg.RoleARN,
+				func(o *stscreds.AssumeRoleOptions) {
+					o.RoleSessionName = cfg.RoleSession
+					if cfg.ExternalID != "" {
+						o.ExternalID = aws.String(cfg.ExternalID)
+					}
+				},
+			),
+		})
+	}
+
+	return nil
+}
+
+// credentialsCacheFile returns the cache file for the profile's credentials, or for the role assumed on top of it
+func credentialsCacheFile(cfg *Config, roleARN string) string {
+	if roleARN == "" {
+		return fmt.Sprintf("%s/%s-credentials.json", cfg.CacheDir, profileLabel(cfg))
+	}
+	sum := sha256.Sum256([]byte(roleARN + "|" + cfg.ExternalID + "|" + cfg.RoleSession))
+	return fmt.Sprintf("%s/%s-%s-credentials.json", cfg.CacheDir, profileLabel(cfg), hex.EncodeToString(sum[:4]))
+}
+
+// mfaTokenProvider prompts for the MFA token code on the controlling terminal,
+// since stdin/stdout carry the proxied SSH stream
+func mfaTokenProvider() (string, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return "", fmt.Errorf("profile %s requires an MFA code, but there is no terminal to prompt on", profileLabel(&cfg))
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "MFA code for profile %s: ", profileLabel(&cfg))
+	code, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read MFA code: %v", err)
+	}
+	return strings.TrimSpace(code), nil
+}
+
+// fileCredentialsProvider caches credentials of the wrapped provider in a file readable only by the user
+type fileCredentialsProvider struct {
+	path     string
+	provider aws.CredentialsProvider
+}
+
+type cachedCredentials struct {
+	AccessKeyID     string    `json:"access_key_id"`
+	SecretAccessKey string    `json:"secret_access_key"`
+	SessionToken    string    `json:"session_token"`
+	Expires         time.Time `json:"expires"`
+}
+
+func (p *fileCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	if creds, err := p.load(); err == nil {
+		slog.Info("using cached credentials", "expires", creds.Expires)
+		return creds, nil
+	}
+
+	creds, err := p.provider.Retrieve(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if err := p.save(creds); err != nil {
+		slog.Warn("failed to cache credentials", "error", err)
+	}
+	return creds, nil
+}
+
+func (p *fileCredentialsProvider) load() (aws.Credentials, error) {
+	data, err := readCacheFile(p.path)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	var cached cachedCredentials
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to unmarshal cached credentials: %v", err)
+	}
+	if time.Until(cached.Expires) < credentialsExpiryWindow {
+		return aws.Credentials{}, fmt.Errorf("cached credentials are expired")
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     cached.AccessKeyID,
+		SecretAccessKey: cached.SecretAccessKey,
+		SessionToken:    cached.SessionToken,
+		Source:          "ssm-ssh-connect cache",
+		CanExpire:       true,
+		Expires:         cached.Expires.Add(-credentialsExpiryWindow),
+	}, nil
+}
+
+func (p *fileCredentialsProvider) save(creds aws.Credentials) error {
+	if !creds.CanExpire {
+		// long-term credentials don't need caching
+		return nil
+	}
+
+	data, err := json.Marshal(cachedCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expires:         creds.Expires,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials: %v", err)
+	}
+
+	if err := writeCacheFile(p.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write credentials cache: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// daemonDialTimeout bounds connecting to the daemon, a client that gets no answer connects by itself
+const daemonDialTimeout = 100 * time.Millisecond
+
+// daemonWriteTimeout bounds sending the request, daemonResponseTimeout waiting for the answer: the daemon
+// serves one request at a time and may be asking for an MFA code, but a client of a hung daemon connects
+// by itself in the end
+const (
+	daemonWriteTimeout    = time.Second
+	daemonResponseTimeout = time.Minute
+)
+
+var errNoDaemon = errors.New("no daemon listening")
+
+// daemonEnvironment are the variables changing where the AWS config, credentials and region come from.
+// The daemon only serves clients whose values it shares, since it loads the AWS config from its own.
+var daemonEnvironment = []string{"AWS_REGION", "AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE"}
+
+// daemonSocket returns the path of the unix socket the daemon listens on
+func daemonSocket(stateDir string) string {
+	return filepath.Join(stateDir, "daemon.sock")
+}
+
+// daemonRequest asks the daemon to start a session, with the options that decide where to and how.
+// The client reads the public keys, the daemon's key files and ssh-agent may not be the client's.
+type daemonRequest struct {
+	// Op is daemonOpStatus for the daemon's status, or empty to start a session
+	Op           string              `json:"op,omitempty"`
+	Profile      string              `json:"profile"`
+	Name         string              `json:"name"`
+	User         string              `json:"user"`
+	Port         string              `json:"port"`
+	Shell        bool                `json:"shell,omitempty"`
+	Excludes     tagFilters          `json:"excludes,omitempty"`
+	VpcID        string              `json:"vpc_id,omitempty"`
+	SubnetID     string              `json:"subnet_id,omitempty"`
+	PlatformOnly string              `json:"platform,omitempty"`
+	RoleARN      string              `json:"role_arn,omitempty"`
+	ExternalID   string              `json:"external_id,omitempty"`
+	RoleSession  string              `json:"role_session_name,omitempty"`
+	RegionFlag   string              `json:"region,omitempty"`
+	FIPS         bool                `json:"fips,omitempty"`
+	Document     string              `json:"document,omitempty"`
+	Parameters   map[string][]string `json:"parameters,omitempty"`
+	Reason       string              `json:"reason,omitempty"`
+	CacheTTL     time.Duration       `json:"cache_ttl"`
+	NoCache      bool                `json:"no_cache,omitempty"`
+	SharedCache  string              `json:"shared_cache,omitempty"`
+	Resolver     string              `json:"resolver,omitempty"`
+	AllRegions   bool                `json:"all_regions,omitempty"`
+	PublicKeys   [][]byte            `json:"public_keys,omitempty"`
+	Environment  map[string]string   `json:"environment,omitempty"`
+}
+
+// daemonResponse is the daemon's answer: the session-manager-plugin command line connecting to the
+// started session, or why there is none
+type daemonResponse struct {
+	Plugin []string      `json:"plugin,omitempty"`
+	Status *daemonStatus `json:"status,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	// Direct tells the client to connect by itself, the daemon can't serve it as asked
+	Direct string `json:"direct,omitempty"`
+}
+
+// newDaemonRequest returns the request for the session cfg describes
+func newDaemonRequest(cfg *Config, publicKeys [][]byte) daemonRequest {
+	profile := cfg.AwsProfile
+	if profile == "" {
+		// the daemon's environment may have another AWS_PROFILE
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	environment := map[string]string{}
+	for _, name := range daemonEnvironment {
+		if value := os.Getenv(name); value != "" {
+			environment[name] = value
+		}
+	}
+	return daemonRequest{
+		Profile:      profile,
+		Name:         cfg.InstanceName,
+		User:         cfg.InstanceUser,
+		Port:         cfg.Port,
+		Shell:        cfg.Shell,
+		Excludes:     cfg.Excludes,
+		VpcID:        cfg.VpcID,
+		SubnetID:     cfg.SubnetID,
+		PlatformOnly: cfg.PlatformOnly,
+		RoleARN:      cfg.RoleARN,
+		ExternalID:   cfg.ExternalID,
+		RoleSession:  cfg.RoleSession,
+		RegionFlag:   cfg.RegionFlag,
+		FIPS:         cfg.FIPS,
+		Document:     cfg.Document,
+		Parameters:   cfg.Parameters,
+		Reason:       cfg.Reason,
+		CacheTTL:     cfg.CacheTTL,
+		NoCache:      cfg.NoCache,
+		SharedCache:  cfg.SharedCache,
+		Resolver:     cfg.Resolver,
+		AllRegions:   cfg.AllRegions,
+		PublicKeys:   publicKeys,
+		Environment:  environment,
+	}
+}
+
+// apply sets the request's options in cfg, which holds the daemon's own (directories, endpoints, ...)
+func (r daemonRequest) apply(cfg *Config) {
+	cfg.AwsProfile = r.Profile
+	cfg.InstanceName = r.Name
+	cfg.InstanceUser = r.User
+	cfg.Port = r.Port
+	cfg.Shell = r.Shell
+	cfg.Excludes = r.Excludes
+	cfg.VpcID = r.VpcID
+	cfg.SubnetID = r.SubnetID
+	cfg.PlatformOnly = r.PlatformOnly
+	cfg.RoleARN = r.RoleARN
+	cfg.ExternalID = r.ExternalID
+	cfg.RoleSession = r.RoleSession
+	cfg.RegionFlag = r.RegionFlag
+	cfg.FIPS = r.FIPS
+	cfg.Document = r.Document
+	cfg.Parameters = r.Parameters
+	cfg.Reason = r.Reason
+	cfg.CacheTTL = r.CacheTTL
+	cfg.NoCache = r.NoCache
+	cfg.SharedCache = r.SharedCache
+	cfg.Resolver = r.Resolver
+	cfg.AllRegions = r.AllRegions
+}
+
+// environmentDiffers names a variable of daemonEnvironment the client has another value of than the
+// daemon, or returns ""
+func (r daemonRequest) environmentDiffers() string {
+	for _, name := range daemonEnvironment {
+		if r.Environment[name] != os.Getenv(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// credentialSource identifies the AWS config a request needs, requests with the same share its credentials
+func (r daemonRequest) credentialSource() string {
+	return strings.Join([]string{r.Profile, r.RoleARN, r.ExternalID, r.RoleSession, r.RegionFlag, strconv.FormatBool(r.FIPS)}, "|")
+}
+
+// daemonCall sends the request to the daemon listening on the socket and returns its response, with the
+// connection still open. An error wrapping errNoDaemon means no daemon is listening, none answered in
+// time or it asks the client to connect by itself.
+func daemonCall(socket string, request daemonRequest) (daemonResponse, net.Conn, error) {
+	var response daemonResponse
+	conn, err := net.DialTimeout("unix", socket, daemonDialTimeout)
+	if err != nil {
+		return response, nil, fmt.Errorf("%w: %v", errNoDaemon, err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(daemonWriteTimeout))
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		conn.Close()
+		return response, nil, daemonCallError("failed to send request to the daemon", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(daemonResponseTimeout))
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		conn.Close()
+		return response, nil, daemonCallError("failed to read the daemon's response", err)
+	}
+	if response.Error != "" {
+		conn.Close()
+		return response, nil, errors.New(response.Error)
+	}
+	if response.Direct != "" {
+		conn.Close()
+		return response, nil, fmt.Errorf("%w: %s", errNoDaemon, response.Direct)
+	}
+	// the connection stays open for the session
+	conn.SetDeadline(time.Time{})
+	return response, conn, nil
+}
+
+// daemonCallError returns the error of a failed exchange with the daemon, wrapping errNoDaemon when it
+// didn't answer in time
+func daemonCallError(message string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %s: %v", errNoDaemon, message, err)
+	}
+	return fmt.Errorf("%s: %v", message, err)
+}
+
+// daemonConnect asks the daemon to start the session of the request, or to share one, and returns its
+// response. The daemon counts the session active until the returned connection is closed.
+func daemonConnect(socket string, request daemonRequest) (daemonResponse, io.Closer, error) {
+	return daemonCall(socket, request)
+}
+
+// daemonEligible reports whether the daemon can start the session of the command, it has no terminal
+// to ask on and doesn't watch or restart sessions
+func daemonEligible(command string, confirmTags tagFilters) bool {
+	return command == "" && !cfg.DryRun && !cfg.Reconnect && !cfg.StartStopped && !cfg.Banner &&
+		cfg.MaxDuration == 0 && cfg.IdleTimeout == 0 && len(confirmTags) == 0 &&
+		!strings.HasPrefix(cfg.InstanceName, ecsExecPrefix)
+}
+
+// runViaDaemon starts the session through the daemon, if one is listening, and runs the plugin on stdin and stdout.
+// It reports whether a daemon took the request.
+func runViaDaemon() (bool, error) {
+	// the daemon would use its own credentials instead of those in the environment
+	if cfg.AwsProfile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		return false, nil
+	}
+	socket := daemonSocket(cfg.StateDir)
+	if _, err := os.Stat(socket); err != nil {
+		return false, nil
+	}
+	var publicKeys [][]byte
+	if keyPushSkipReason("") == "" {
+		keys, err := readPublicKeys()
+		if err != nil {
+			return true, err
+		}
+		publicKeys = keys
+	}
+	response, conn, err := daemonConnect(socket, newDaemonRequest(&cfg, publicKeys))
+	if errors.Is(err, errNoDaemon) {
+		slog.Info("daemon is not serving the connection, connecting without it", "error", err)
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	defer conn.Close()
+	connected()
+	slog.Info("session started by the daemon")
+	args := response.Plugin
+	// the daemon's own warning about an old plugin goes to its terminal
+	checkPluginVersion(args[0])
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	var answered atomic.Bool
+	document, _ := sessionDocument()
+	if document == "AWS-StartSSHSession" {
+		cmd.Stdout = answerWriter{w: os.Stdout, answered: &answered}
+	}
+	if err := cmd.Start(); err != nil {
+		return true, fmt.Errorf("failed to start session-manager-plugin: %v", err)
+	}
+	defer trackChild(cmd.Process)()
+	err = cmd.Wait()
+	if stopping() {
+		return true, errSessionStopped
+	}
+	if err != nil {
+		return true, fmt.Errorf("session-manager-plugin: %w", err)
+	}
+	if document == "AWS-StartSSHSession" && !answered.Load() {
+		return true, noSSHServer()
+	}
+	return true, nil
+}
+
+// daemon keeps AWS configs, with their cached credentials, and resolved instances in memory between
+// connections. Requests are served one at a time, since they run on the global cfg and awsConfig.
+type daemon struct {
+	mu   sync.Mutex
+	base Config
+	// configs are the loaded AWS configs by credential source
+	configs map[string]aws.Config
+	// resolved are the instances looked up, by cache key
+	resolved map[string]cacheEntry
+
+	// statsMu guards what status reports, which is read while a request is served
+	statsMu     sync.Mutex
+	started     time.Time
+	sessions    map[net.Conn]daemonSession
+	lookups     int
+	cacheHits   int
+	credentials map[string]time.Time
+	connections map[daemonHost]int
+	// refreshers keep the keys of active sessions authorized, by instance, user and keys
+	refreshers map[string]*keyRefresher
+}
+
+// newDaemon returns a daemon serving requests on top of the base config
+func newDaemon(base Config, now time.Time) *daemon {
+	return &daemon{
+		base:        base,
+		configs:     map[string]aws.Config{},
+		resolved:    map[string]cacheEntry{},
+		started:     now,
+		sessions:    map[net.Conn]daemonSession{},
+		credentials: map[string]time.Time{},
+		connections: map[daemonHost]int{},
+		refreshers:  map[string]*keyRefresher{},
+	}
+}
+
+// connect starts the session of the request and returns the session-manager-plugin command line
+func (d *daemon) connect(request daemonRequest) (daemonResponse, daemonSession, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cfg = d.base
+	request.apply(&cfg)
+
+	source := request.credentialSource()
+	if config, ok := d.configs[source]; ok {
+		awsConfig = config
+	} else {
+		if err := loadAWSConfig(); err != nil {
+			return daemonResponse{}, daemonSession{}, fmt.Errorf("unable to load AWS config: %v", err)
+		}
+		if err := ensureCredentials(); err != nil {
+			return daemonResponse{}, daemonSession{}, err
+		}
+		d.configs[source] = awsConfig
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	if creds, err := awsConfig.Credentials.Retrieve(ctx); err == nil && creds.CanExpire {
+		d.statsMu.Lock()
+		d.credentials[credentialLabel(&cfg)] = creds.Expires
+		d.statsMu.Unlock()
+	}
+
+	// resolved instances are kept in memory like in the cache, which is still read and written
+	key := cacheEntryKey(&cfg)
+	useCache := cacheable(cfg.InstanceName) && cfg.CacheTTL > 0
+	remember := func() {
+		if data, err := json.Marshal(&cfg); err == nil && useCache {
+			d.resolved[key] = cacheEntry{Saved: time.Now(), Instance: data}
+		}
+	}
+	if useCache && !cfg.NoCache {
+		entry, inMemory := d.resolved[key]
+		inMemory = inMemory && time.Since(entry.Saved) <= cfg.CacheTTL
+		if inMemory {
+			if err := json.Unmarshal(entry.Instance, &cfg); err != nil {
+				return daemonResponse{}, daemonSession{}, fmt.Errorf("failed to unmarshal config: %v", err)
+			}
+		} else if err := loadCache(&cfg); errors.Is(err, errInstanceNotFound) {
+			return daemonResponse{}, daemonSession{}, err
+		} else if cfg.InstanceID == "" && cfg.SharedCache != "" {
+			if err := loadSharedCache(&cfg); err != nil {
+				slog.Info("instance details not found in the shared cache", "error", err)
+			}
+		}
+		cfg.FromCache = cfg.InstanceID != ""
+		d.statsMu.Lock()
+		d.lookups++
+		if cfg.FromCache {
+			d.cacheHits++
+		}
+		d.statsMu.Unlock()
+		if !inMemory && cfg.FromCache {
+			remember()
+		}
+	}
+	if cfg.InstanceID == "" {
+		if err := getInstanceDetails(); err != nil {
+			if useCache && errors.Is(err, errInstanceNotFound) {
+				if err := saveNotFound(&cfg); err != nil {
+					slog.Warn("failed to save cache", "error", err)
+				}
+			}
+			return daemonResponse{}, daemonSession{}, err
+		}
+		if useCache {
+			if err := saveCache(&cfg); err != nil {
+				slog.Warn("failed to save cache", "error", err)
+			}
+		}
+		remember()
+	}
+	awsConfig.Region = cfg.Region
+
+	// a cached instance that is gone is looked up again, once
+	retry := func(err error) bool {
+		if !staleInstance(err) {
+			return false
+		}
+		delete(d.resolved, key)
+		if !refreshCachedInstance(err) {
+			return false
+		}
+		remember()
+		return true
+	}
+
+	pushing := keyPushSkipReason("") == "" && len(request.PublicKeys) > 0
+	if reason := keyPushSkipReason(""); reason != "" {
+		slog.Info(reason + ", skipping SSH public key push")
+	} else if pushing {
+		err := sendPublicKeys(request.PublicKeys)
+		if err != nil && retry(err) {
+			err = sendPublicKeys(request.PublicKeys)
+		}
+		if err != nil {
+			slog.Error("failed to send SSH public key", "error", err)
+		}
+	}
+
+	session := daemonSession{
+		Name:       cfg.InstanceName,
+		Profile:    profileLabel(&cfg),
+		InstanceID: cfg.InstanceID,
+		User:       cfg.InstanceUser,
+		Started:    time.Now(),
+	}
+	cmd, sessionID, err := pluginCommand()
+	if err != nil && retry(err) {
+		cmd, sessionID, err = pluginCommand()
+	}
+	if err != nil {
+		return daemonResponse{}, daemonSession{}, err
+	}
+	session.SessionID = sessionID
+	if pushing {
+		session.refresh = d.keyRefresh(source, request.PublicKeys)
+	}
+	client := ssmClient()
+	session.terminate = func() error { return terminateSession(client, sessionID) }
+	return daemonResponse{Plugin: cmd.Args}, session, nil
+}
+
+// serve answers the request on the connection. A session it started counts as active until the client
+// closes the connection, once its plugin is done.
+func (d *daemon) serve(conn net.Conn, connect func(daemonRequest) (daemonResponse, daemonSession, error)) {
+	defer conn.Close()
+	var request daemonRequest
+	var response daemonResponse
+	var session daemonSession
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		response.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if request.Op == daemonOpStatus {
+		status := d.status(time.Now())
+		response.Status = &status
+	} else if name := request.environmentDiffers(); name != "" {
+		// the daemon would use its own config files or region
+		response.Direct = fmt.Sprintf("the daemon runs with another %s", name)
+	} else if connected, started, err := connect(request); err != nil {
+		slog.Error("daemon failed to start session", "name", request.Name, "error", err)
+		response.Error = err.Error()
+	} else {
+		slog.Info("daemon connected client", "name", request.Name, "session_id", started.SessionID)
+		response = connected
+		session = started
+	}
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		slog.Warn("failed to answer daemon client", "error", err)
+		return
+	}
+	if response.Plugin == nil {
+		return
+	}
+
+	d.statsMu.Lock()
+	d.sessions[conn] = session
+	d.connections[daemonHost{Profile: session.Profile, Name: session.Name}]++
+	d.statsMu.Unlock()
+	if session.refresh != nil {
+		release := d.holdKeys(session.refresh)
+		defer release()
+	}
+	io.Copy(io.Discard, conn)
+	d.statsMu.Lock()
+	delete(d.sessions, conn)
+	d.statsMu.Unlock()
+	if session.terminate != nil {
+		if err := session.terminate(); err != nil {
+			slog.Warn("failed to terminate session", "session_id", session.SessionID, "error", err)
+		}
+	}
+}
+
+// listenDaemon listens on the daemon's socket, taking over a socket left behind by a daemon that is gone
+func listenDaemon(socket string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", socket)
+	}
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", socket, err)
+	}
+	// only the user may connect; the state directory is the user's too
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %v", socket, err)
+	}
+	return listener, nil
+}
+
+// runDaemon serves connect requests of the clients on the socket until interrupted or terminated
+func runDaemon() error {
+	socket := daemonSocket(cfg.StateDir)
+	listener, err := listenDaemon(socket)
+	if err != nil {
+		return err
+	}
+	d := newDaemon(cfg, time.Now())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt}, terminationSignals...)...)
+	go func() {
+		s := <-signals
+		for s == syscall.SIGHUP {
+			s = <-signals
+		}
+		slog.Info("daemon stopping", "signal", s.String())
+		listener.Close()
+	}()
+
+	slog.Info("daemon listening", "socket", socket)
+	fmt.Fprintf(os.Stderr, "Listening on %s\n", socket)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			os.Remove(socket)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+		go d.serve(conn, d.connect)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// daemonOpStatus asks the daemon for its status instead of a session
+const daemonOpStatus = "status"
+
+// daemonSession is a session the daemon started, active while its client runs the plugin
+type daemonSession struct {
+	Name       string    `json:"name"`
+	Profile    string    `json:"profile"`
+	InstanceID string    `json:"instance_id"`
+	User       string    `json:"user,omitempty"`
+	SessionID  string    `json:"session_id"`
+	Started    time.Time `json:"started"`
+
+	// refresh keeps the session's keys authorized while it is active, nil if none were pushed
+	refresh *keyRefresh
+	// terminate ends the session once the client is done with it
+	terminate func() error
+}
+
+// credentialExpiry is when the credentials of a profile, or of a role assumed with it, expire
+type credentialExpiry struct {
+	Profile string    `json:"profile"`
+	Expires time.Time `json:"expires"`
+}
+
+// daemonHost is a target of the daemon's sessions
+type daemonHost struct {
+	Profile string
+	Name    string
+}
+
+// hostConnections counts the sessions the daemon started to a target
+type hostConnections struct {
+	Profile     string `json:"profile"`
+	Name        string `json:"name"`
+	Connections int    `json:"connections"`
+}
+
+// daemonStatus is what the status command shows
+type daemonStatus struct {
+	Started     time.Time          `json:"started"`
+	Sessions    []daemonSession    `json:"sessions"`
+	Lookups     int                `json:"lookups"`
+	CacheHits   int                `json:"cache_hits"`
+	Credentials []credentialExpiry `json:"credentials"`
+	Hosts       []hostConnections  `json:"hosts"`
+}
+
+// credentialLabel names the credentials of cfg: the profile, and the role assumed on top of it
+func credentialLabel(cfg *Config) string {
+	if cfg.RoleARN != "" {
+		return profileLabel(cfg) + " as " + cfg.RoleARN
+	}
+	return profileLabel(cfg)
+}
+
+// status returns the daemon's sessions and counters, sorted for display
+func (d *daemon) status(now time.Time) daemonStatus {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+
+	status := daemonStatus{
+		Started:     d.started,
+		Sessions:    []daemonSession{},
+		Lookups:     d.lookups,
+		CacheHits:   d.cacheHits,
+		Credentials: []credentialExpiry{},
+		Hosts:       []hostConnections{},
+	}
+	for _, session := range d.sessions {
+		status.Sessions = append(status.Sessions, session)
+	}
+	slices.SortFunc(status.Sessions, func(a, b daemonSession) int {
+		return a.Started.Compare(b.Started)
+	})
+	for profile, expires := range d.credentials {
+		// expired credentials are refreshed on the next connection, there's nothing to show until then
+		if expires.After(now) {
+			status.Credentials = append(status.Credentials, credentialExpiry{Profile: profile, Expires: expires})
+		}
+	}
+	slices.SortFunc(status.Credentials, func(a, b credentialExpiry) int {
+		return cmp.Compare(a.Profile, b.Profile)
+	})
+	for host, count := range d.connections {
+		status.Hosts = append(status.Hosts, hostConnections{Profile: host.Profile, Name: host.Name, Connections: count})
+	}
+	slices.SortFunc(status.Hosts, func(a, b hostConnections) int {
+		return cmp.Or(cmp.Compare(b.Connections, a.Connections), cmp.Compare(a.Name, b.Name), cmp.Compare(a.Profile, b.Profile))
+	})
+	return status
+}
+
+// queryDaemonStatus asks the daemon listening on the socket for its status
+func queryDaemonStatus(socket string) (daemonStatus, error) {
+	response, conn, err := daemonCall(socket, daemonRequest{Op: daemonOpStatus})
+	if err != nil {
+		return daemonStatus{}, err
+	}
+	conn.Close()
+	if response.Status == nil {
+		return daemonStatus{}, fmt.Errorf("the daemon sent no status")
+	}
+	return *response.Status, nil
+}
+
+// writeDaemonStatus writes the daemon's status as tables, or as JSON
+func writeDaemonStatus(w io.Writer, status daemonStatus, output string, now time.Time) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+
+	fmt.Fprintf(w, "Running for %v\n", now.Sub(status.Started).Truncate(time.Second))
+	hitRate := 0
+	if status.Lookups > 0 {
+		hitRate = status.CacheHits * 100 / status.Lookups
+	}
+	fmt.Fprintf(w, "Cache hits: %d of %d lookups (%d%%)\n", status.CacheHits, status.Lookups, hitRate)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nACTIVE SESSIONS (%d)\n", len(status.Sessions))
+	if len(status.Sessions) > 0 {
+		fmt.Fprintln(tw, "NAME\tPROFILE\tINSTANCE ID\tUSER\tSESSION ID\tAGE")
+	}
+	for _, s := range status.Sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\n", s.Name, s.Profile, s.InstanceID, s.User, s.SessionID, now.Sub(s.Started).Truncate(time.Second))
+	}
+	fmt.Fprintln(tw, "\nCREDENTIALS")
+	if len(status.Credentials) > 0 {
+		fmt.Fprintln(tw, "PROFILE\tEXPIRES IN")
+	}
+	for _, c := range status.Credentials {
+		fmt.Fprintf(tw, "%s\t%v\n", c.Profile, c.Expires.Sub(now).Truncate(time.Second))
+	}
+	fmt.Fprintln(tw, "\nCONNECTIONS")
+	if len(status.Hosts) > 0 {
+		fmt.Fprintln(tw, "NAME\tPROFILE\tCOUNT")
+	}
+	for _, h := range status.Hosts {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", h.Name, h.Profile, h.Connections)
+	}
+	return tw.Flush()
+}
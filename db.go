@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// dbClientPorts are the default ports of the database clients, used to tell the client from the endpoint port and the other way round
+var dbClientPorts = map[string]string{
+	"psql":      "5432",
+	"mysql":     "3306",
+	"redis-cli": "6379",
+}
+
+// dbTunnelTimeout bounds the wait for the port forward before giving up on the database client
+const dbTunnelTimeout = 30 * time.Second
+
+// dbClientDone is closed once the database client exits, which ends the port forwarding session
+var dbClientDone chan struct{}
+
+// parseDBEndpoint splits the endpoint of an RDS or ElastiCache cluster given as host[:port]
+// and picks the client: an explicit client determines the default port, a well-known port the client
+func parseDBEndpoint(endpoint, client string) (host, port, dbClient string, err error) {
+	host, port = endpoint, ""
+	if h, p, err := net.SplitHostPort(endpoint); err == nil {
+		host, port = h, p
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("invalid database endpoint %q, expected host[:port]", endpoint)
+	}
+
+	switch {
+	case client != "":
+		if _, ok := dbClientPorts[client]; !ok {
+			return "", "", "", fmt.Errorf("unsupported database client %q, expected psql, mysql or redis-cli", client)
+		}
+		if port == "" {
+			port = dbClientPorts[client]
+		}
+	case port == "":
+		return "", "", "", fmt.Errorf("database endpoint %q has no port, pass host:port or --db-client", endpoint)
+	default:
+		for c, p := range dbClientPorts {
+			if p == port {
+				client = c
+			}
+		}
+		if client == "" {
+			return "", "", "", fmt.Errorf("no known database client for port %s, pass --db-client", port)
+		}
+	}
+	if _, err := parseForward(fmt.Sprintf("0:%s:%s", host, port)); err != nil {
+		return "", "", "", err
+	}
+	return host, port, client, nil
+}
+
+// dbClientArgs returns the arguments that connect the client to the local end of the tunnel,
+// extra arguments (e.g. --tls for encrypted ElastiCache) are passed on as they are
+func dbClientArgs(client, localPort, user, database string, extra []string) []string {
+	var args []string
+	switch client {
+	case "psql":
+		args = []string{"-h", "127.0.0.1", "-p", localPort}
+		if user != "" {
+			args = append(args, "-U", user)
+		}
+		if database != "" {
+			args = append(args, "-d", database)
+		}
+	case "mysql":
+		args = []string{"-h", "127.0.0.1", "-P", localPort}
+		if user != "" {
+			args = append(args, "-u", user)
+		}
+		if database != "" {
+			args = append(args, "-D", database)
+		}
+	case "redis-cli":
+		args = []string{"-h", "127.0.0.1", "-p", localPort}
+		if user != "" {
+			args = append(args, "--user", user)
+		}
+		if database != "" {
+			args = append(args, "-n", database)
+		}
+	}
+	return append(args, extra...)
+}
+
+// waitForPort waits until the forwarded local port accepts connections
+func waitForPort(localPort string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", localPort), time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// runDBClient runs the port forwarding session in the background, starts the database client once the
+// tunnel is up and ends the session when the client exits. It returns the client's exit code.
+func runDBClient(localPort string, extra []string) int {
+	dbClientDone = make(chan struct{})
+	tunnelDone := make(chan error, 1)
+	go func() {
+		tunnelDone <- startSSMSessionWithPlugin()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		ready <- waitForPort(localPort, dbTunnelTimeout)
+	}()
+	select {
+	case err := <-tunnelDone:
+		slog.Error("port forwarding session ended before the database client started", "error", err)
+		fmt.Fprintf(os.Stderr, "Failed to set up the tunnel: %v\n", err)
+		return 1
+	case err := <-ready:
+		if err != nil {
+			close(dbClientDone)
+			slog.Error("port forward did not come up", "error", err)
+			fmt.Fprintf(os.Stderr, "Port forward did not come up: %v\n", err)
+			return 1
+		}
+	}
+
+	args := dbClientArgs(cfg.DBClient, localPort, cfg.DBUser, cfg.DBName, extra)
+	slog.Info("starting database client", "client", cfg.DBClient, "args", args)
+	cmd := exec.Command(cfg.DBClient, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+
+	close(dbClientDone)
+	select {
+	case <-tunnelDone:
+	case <-time.After(5 * time.Second):
+		slog.Warn("port forwarding session did not end")
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		slog.Error("failed to run database client", "error", err)
+		fmt.Fprintf(os.Stderr, "Failed to run %s: %v\n", cfg.DBClient, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// appDirs are where the tool keeps its files: the config file in Config, resolved instances and
+// credentials (and the keys pushed) in Cache, and logs and mux sockets in State
+type appDirs struct {
+	Config string
+	Cache  string
+	State  string
+}
+
+// xdgDirs returns the directories following the XDG base directory specification, under
+// XDG_CONFIG_HOME, XDG_CACHE_HOME and XDG_STATE_HOME or their defaults in the home directory.
+// Windows has no XDG defaults, there the application data directories are used.
+func xdgDirs(getenv func(string) string, home, goos string) appDirs {
+	base := func(env, fallback string) string {
+		if dir := getenv(env); filepath.IsAbs(dir) {
+			return dir
+		}
+		return fallback
+	}
+	var dirs appDirs
+	if goos == "windows" {
+		dirs = appDirs{
+			Config: base("XDG_CONFIG_HOME", getenv("APPDATA")),
+			Cache:  base("XDG_CACHE_HOME", getenv("LOCALAPPDATA")),
+			State:  base("XDG_STATE_HOME", getenv("LOCALAPPDATA")),
+		}
+	} else {
+		dirs = appDirs{
+			Config: base("XDG_CONFIG_HOME", filepath.Join(home, ".config")),
+			Cache:  base("XDG_CACHE_HOME", filepath.Join(home, ".cache")),
+			State:  base("XDG_STATE_HOME", filepath.Join(home, ".local", "state")),
+		}
+	}
+	dirs.Config = filepath.Join(dirs.Config, "ssm-ssh-connect")
+	dirs.Cache = filepath.Join(dirs.Cache, "ssm-ssh-connect")
+	dirs.State = filepath.Join(dirs.State, "ssm-ssh-connect")
+	// Windows keeps cache and state in the same directory
+	if dirs.State == dirs.Cache {
+		dirs.State = filepath.Join(dirs.State, "state")
+	}
+	return dirs
+}
+
+// defaultDirs returns the directories of the user running the tool
+func defaultDirs() appDirs {
+	return xdgDirs(os.Getenv, homeDir(), runtime.GOOS)
+}
+
+// legacyHome is the directory all files were kept in before the XDG base directories
+func legacyHome() string {
+	return filepath.Join(homeDir(), ".ssm-ssh-connect")
+}
+
+// legacyDir returns the directory a file of the legacy home directory belongs in
+func (d appDirs) legacyDir(name string) string {
+	switch {
+	case name == "config.yaml":
+		return d.Config
+	case strings.HasSuffix(name, ".log"):
+		return d.State
+	}
+	return d.Cache
+}
+
+// migrateLegacyHome moves the files of the legacy home directory into the XDG directories, without
+// replacing files already there, and removes the legacy directory once it is empty
+func migrateLegacyHome(legacy string, dirs appDirs) error {
+	entries, err := os.ReadDir(legacy)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", legacy, err)
+	}
+	for _, entry := range entries {
+		dir := dirs.legacyDir(entry.Name())
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+		target := filepath.Join(dir, entry.Name())
+		if _, err := os.Lstat(target); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(legacy, entry.Name()), target); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %v", entry.Name(), dir, err)
+		}
+	}
+	// fails while files that were already migrated remain
+	os.Remove(legacy)
+	return nil
+}
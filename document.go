@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// documentParameters is a repeatable flag of session document parameters, as key=value
+type documentParameters map[string][]string
+
+func (p *documentParameters) String() string {
+	return strings.Join(p.values(), ",")
+}
+
+func (p *documentParameters) values() []string {
+	var s []string
+	for key, values := range *p {
+		for _, value := range values {
+			s = append(s, key+"="+value)
+		}
+	}
+	sort.Strings(s)
+	return s
+}
+
+func (p *documentParameters) Set(value string) error {
+	key, parameterValue, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid parameter %q, expected key=value", value)
+	}
+	if *p == nil {
+		*p = documentParameters{}
+	}
+	(*p)[key] = append((*p)[key], parameterValue)
+	return nil
+}
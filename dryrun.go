@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"io"
+	"strings"
+)
+
+// dryRun reports what the command would do with the resolved instance: the instance as DescribeInstances
+// returns it, the key that would be pushed and the command line that would run. No session is started,
+// no key is pushed, and the session token in the plugin's command line is a placeholder.
+func dryRun(w io.Writer, command string, passArgs []string, db bool) error {
+	fmt.Fprintf(w, "Target %s resolved to %s in %s\n", cfg.InstanceName, cfg.InstanceID, cfg.Region)
+	if !cfg.Hybrid {
+		instances, err := describeInstances(ec2Client(), &ec2.DescribeInstancesInput{InstanceIds: []string{cfg.InstanceID}})
+		if err != nil {
+			return fmt.Errorf("failed to describe instance: %v", err)
+		}
+		data, err := json.MarshalIndent(instances, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal instance: %v", err)
+		}
+		fmt.Fprintf(w, "DescribeInstances:\n%s\n", data)
+	}
+
+	if command == "run" {
+		fmt.Fprintf(w, "Would run with %s: %s\n", runDocument(), cfg.Command)
+		return nil
+	}
+	if program, args := wrappedCommand(command, passArgs); program != "" {
+		args, err := sshArgs(args)
+		if err != nil {
+			return err
+		}
+		// the ProxyCommand pushes the key
+		fmt.Fprintf(w, "Would run: %s\n", quoteArgs(append([]string{program}, args...)))
+		return nil
+	}
+
+	if reason := keyPushSkipReason(command); reason != "" {
+		fmt.Fprintf(w, "No SSH public key push: %s\n", reason)
+	} else {
+		keys, err := readPublicKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Fprintf(w, "Would push SSH public key for %s: %s\n", cfg.InstanceUser, strings.TrimSpace(string(key)))
+		}
+	}
+
+	args, err := pluginArgs(StartSessionResponseData{SessionID: "(dry run)", StreamURL: "(dry run)", TokenValue: "(redacted)"}, sessionRequest())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Would run: %s\n", quoteArgs(args))
+	if db {
+		fmt.Fprintf(w, "Would run: %s\n", quoteArgs(append([]string{cfg.DBClient}, dbClientArgs(cfg.DBClient, cfg.Forwards[0].LocalPort, cfg.DBUser, cfg.DBName, passArgs)...)))
+	}
+	return nil
+}
+
+// quoteArgs joins the command line for a shell
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecsTypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"strings"
+)
+
+// ecsDescribeBatchSize is the maximum number of items DescribeTasks and DescribeContainerInstances accept
+const ecsDescribeBatchSize = 100
+
+// getECSServiceInstanceIDs returns IDs of the EC2 container instances running tasks of the ECS service,
+// target is given as <cluster>/<service>
+func getECSServiceInstanceIDs(target string) ([]string, error) {
+	cluster, service, ok := strings.Cut(target, "/")
+	if !ok || cluster == "" || service == "" {
+		return nil, fmt.Errorf("invalid ECS target %q, expected ecs:<cluster>/<service>", target)
+	}
+
+	client := ecs.NewFromConfig(awsConfig)
+
+	var taskArns []string
+	paginator := ecs.NewListTasksPaginator(client, &ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		ServiceName:   aws.String(service),
+		DesiredStatus: ecsTypes.DesiredStatusRunning,
+	})
+	for paginator.HasMorePages() {
+		ctx, cancel := apiContext()
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ECS tasks: %v", err)
+		}
+		taskArns = append(taskArns, page.TaskArns...)
+	}
+	if len(taskArns) == 0 {
+		return nil, fmt.Errorf("ECS service %q has no running tasks", target)
+	}
+
+	// several tasks may share the same container instance
+	seen := map[string]bool{}
+	var containerInstances []string
+	for _, batch := range batches(taskArns, ecsDescribeBatchSize) {
+		ctx, cancel := apiContext()
+		described, err := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(cluster),
+			Tasks:   batch,
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe ECS tasks: %v", err)
+		}
+		for _, task := range described.Tasks {
+			arn := aws.ToString(task.ContainerInstanceArn)
+			if arn != "" && !seen[arn] {
+				seen[arn] = true
+				containerInstances = append(containerInstances, arn)
+			}
+		}
+	}
+	if len(containerInstances) == 0 {
+		return nil, fmt.Errorf("ECS service %q has no tasks on EC2 container instances (Fargate tasks have no instance to connect to)", target)
+	}
+
+	var ids []string
+	for _, batch := range batches(containerInstances, ecsDescribeBatchSize) {
+		ctx, cancel := apiContext()
+		result, err := client.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            aws.String(cluster),
+			ContainerInstances: batch,
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe ECS container instances: %v", err)
+		}
+		for _, containerInstance := range result.ContainerInstances {
+			if id := aws.ToString(containerInstance.Ec2InstanceId); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("ECS service %q container instances have no EC2 instance IDs", target)
+	}
+
+	return ids, nil
+}
+
+// batches splits items into consecutive chunks of at most size elements
+func batches(items []string, size int) [][]string {
+	var result [][]string
+	for len(items) > size {
+		result = append(result, items[:size])
+		items = items[size:]
+	}
+	if len(items) > 0 {
+		result = append(result, items)
+	}
+	return result
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ecsExecPrefix marks targets that are containers of ECS tasks (e.g. on Fargate) instead of instances
+const ecsExecPrefix = "ecs-exec:"
+
+// ecsExecShell is run in the container when no command is given
+const ecsExecShell = "/bin/sh"
+
+// parseECSExecTarget splits a target given as ecs-exec:<cluster>/<task>/<container>,
+// the cluster may be its name or its ARN, the task its ID or its ARN
+func parseECSExecTarget(target string) (cluster, task, container string, err error) {
+	spec := strings.TrimPrefix(target, ecsExecPrefix)
+	i, j := strings.Index(spec, "/"), strings.LastIndex(spec, "/")
+	if strings.HasPrefix(spec, "arn:") {
+		// the slash of arn:<partition>:ecs:<region>:<account>:cluster/<name> is the ARN's own
+		if k := strings.Index(spec, ":cluster/"); k >= 0 && i == k+len(":cluster/")-1 {
+			i = strings.Index(spec[i+1:], "/")
+			if i > 0 {
+				i += k + len(":cluster/")
+			}
+		}
+	}
+	if i <= 0 || j == i || j == len(spec)-1 {
+		return "", "", "", fmt.Errorf("invalid ECS Exec target %q, expected ecs-exec:<cluster>/<task>/<container>", target)
+	}
+	return spec[:i], spec[i+1 : j], spec[j+1:], nil
+}
+
+// ecsExecSessionTarget returns the SSM target of the container, ecs:<cluster>_<task-id>_<runtime-id>,
+// which the session-manager-plugin needs to resume the session
+func ecsExecSessionTarget(cluster, task, runtimeID string) string {
+	cluster = cluster[strings.LastIndex(cluster, "/")+1:]
+	task = task[strings.LastIndex(task, "/")+1:]
+	return fmt.Sprintf("ecs:%s_%s_%s", cluster, task, runtimeID)
+}
+
+// runECSExec runs the command in the container with ECS Exec and hands the returned session
+// to the session-manager-plugin, the same way `aws ecs execute-command` does
+func runECSExec(target, command string) error {
+	cluster, task, container, err := parseECSExecTarget(target)
+	if err != nil {
+		return err
+	}
+	if command == "" {
+		command = ecsExecShell
+	}
+
+	client := ecs.NewFromConfig(awsConfig)
+
+	ctx, cancel := apiContext()
+	defer cancel()
+	tasks, err := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(cluster),
+		Tasks:   []string{task},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe ECS task: %v", err)
+	}
+	if len(tasks.Tasks) == 0 {
+		return fmt.Errorf("ECS task %q not found in cluster %q", task, cluster)
+	}
+	if !tasks.Tasks[0].EnableExecuteCommand {
+		return fmt.Errorf("ECS Exec is not enabled for task %q, start it with --enable-execute-command", task)
+	}
+	runtimeID := ""
+	for _, c := range tasks.Tasks[0].Containers {
+		if aws.ToString(c.Name) == container {
+			runtimeID = aws.ToString(c.RuntimeId)
+		}
+	}
+	if runtimeID == "" {
+		return fmt.Errorf("container %q of ECS task %q not found or not running", container, task)
+	}
+
+	slog.Info("starting ECS Exec session", "cluster", cluster, "task", task, "container", container)
+	ctx, cancel = apiContext()
+	defer cancel()
+	output, err := client.ExecuteCommand(ctx, &ecs.ExecuteCommandInput{
+		Cluster:     aws.String(cluster),
+		Task:        aws.String(task),
+		Container:   aws.String(container),
+		Command:     aws.String(command),
+		Interactive: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute command in ECS container: %v", err)
+	}
+	connected()
+
+	// ExecuteCommand takes no reason, the audit log still records it
+	audit(auditEntry{
+		Region:    awsConfig.Region,
+		SessionID: aws.ToString(output.Session.SessionId),
+	})
+
+	session, err := json.Marshal(StartSessionResponseData{
+		SessionID:  aws.ToString(output.Session.SessionId),
+		StreamURL:  aws.ToString(output.Session.StreamUrl),
+		TokenValue: aws.ToString(output.Session.TokenValue),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal ECS Exec session: %v", err)
+	}
+	request, err := json.Marshal(map[string]string{"Target": ecsExecSessionTarget(cluster, task, runtimeID)})
+	if err != nil {
+		return fmt.Errorf("failed to marshal ECS Exec target: %v", err)
+	}
+
+	endpoint, err := ssmEndpoint(awsConfig.Region, cfg.FIPS)
+	if err != nil {
+		return err
+	}
+	pluginPath, err := findPlugin()
+	if err != nil {
+		return err
+	}
+	checkPluginVersion(pluginPath)
+
+	cmd := exec.Command(pluginPath, string(session), awsConfig.Region, "StartSession", cfg.AwsProfile, string(request), endpoint)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start session-manager-plugin: %v", err)
+	}
+	defer trackChild(cmd.Process)()
+	err = cmd.Wait()
+	if err := terminateSession(ssmClient(), aws.ToString(output.Session.SessionId)); err != nil {
+		slog.Warn("failed to terminate session", "session_id", aws.ToString(output.Session.SessionId), "error", err)
+	}
+	if stopping() {
+		return errSessionStopped
+	}
+	if err != nil {
+		return fmt.Errorf("session-manager-plugin: %w", err)
+	}
+	return nil
+}
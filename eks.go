@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"strings"
+)
+
+// eksFilters returns DescribeInstances filters selecting worker nodes of an EKS cluster,
+// target is given as <cluster>, <cluster>/<node-name> or <cluster>/<tag-key>=<value>
+// (e.g. eks:prod/eks:nodegroup-name=workers, since node labels are mirrored to node group tags)
+func eksFilters(target string) ([]ec2Types.Filter, error) {
+	cluster, node, _ := strings.Cut(target, "/")
+	if cluster == "" {
+		return nil, fmt.Errorf("invalid EKS target %q, expected eks:<cluster>[/<node-name>|/<tag-key>=<value>]", target)
+	}
+
+	filters := []ec2Types.Filter{
+		{
+			Name:   aws.String("tag-key"),
+			Values: []string{"kubernetes.io/cluster/" + cluster},
+		},
+	}
+
+	key, value, isSelector := strings.Cut(node, "=")
+	switch {
+	case node == "":
+		// any node of the cluster
+	case isSelector:
+		filters = append(filters, ec2Types.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []string{value},
+		})
+	case instanceIDPattern.MatchString(node):
+		filters = append(filters, ec2Types.Filter{
+			Name:   aws.String("instance-id"),
+			Values: []string{node},
+		})
+	default:
+		// EKS node names are the instances' private DNS names
+		filters = append(filters, ec2Types.Filter{
+			Name:   aws.String("private-dns-name"),
+			Values: []string{node},
+		})
+	}
+
+	return filters, nil
+}
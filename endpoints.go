@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// ec2Client creates an EC2 client, honouring a custom endpoint such as a VPC interface endpoint
+func ec2Client(optFns ...func(*ec2.Options)) *ec2.Client {
+	if cfg.EC2Endpoint != "" {
+		optFns = append(optFns, func(o *ec2.Options) {
+			o.BaseEndpoint = aws.String(cfg.EC2Endpoint)
+		})
+	}
+	return ec2.NewFromConfig(awsConfig, optFns...)
+}
+
+// ec2InstanceConnectClient creates an EC2 Instance Connect client, honouring a custom endpoint
+func ec2InstanceConnectClient() *ec2instanceconnect.Client {
+	return ec2instanceconnect.NewFromConfig(awsConfig, func(o *ec2instanceconnect.Options) {
+		if cfg.EC2InstanceConnectEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.EC2InstanceConnectEndpoint)
+		}
+	})
+}
+
+// ssmClient creates an SSM client, honouring a custom endpoint
+func ssmClient() *ssm.Client {
+	return ssm.NewFromConfig(awsConfig, func(o *ssm.Options) {
+		if cfg.SSMEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.SSMEndpoint)
+		}
+	})
+}
+
+// ssmEndpoint resolves the SSM endpoint handed to the session-manager-plugin through the SDK,
+// so that regions outside the aws partition (us-gov-*, cn-*) get their own DNS suffix
+// and --fips gets the FIPS endpoint that the API calls use as well. A custom endpoint takes precedence.
+func ssmEndpoint(region string, fips bool) (string, error) {
+	if cfg.SSMEndpoint != "" {
+		return cfg.SSMEndpoint, nil
+	}
+
+	endpoint, err := ssm.NewDefaultEndpointResolverV2().ResolveEndpoint(context.Background(), ssm.EndpointParameters{
+		Region:  aws.String(region),
+		UseFIPS: aws.Bool(fips),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve SSM endpoint for region %s: %v", region, err)
+	}
+	return endpoint.URI.String(), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"gopkg.in/yaml.v3"
+	"path"
+	"strings"
+)
+
+// tagFilter matches instances by tag, value may be a glob
+type tagFilter struct {
+	Key   string
+	Value string
+}
+
+// tagFilters is a repeatable flag of tag:Key=Value filters
+type tagFilters []tagFilter
+
+func (f *tagFilters) String() string {
+	return strings.Join(f.values(), ",")
+}
+
+func (f *tagFilters) values() []string {
+	var s []string
+	for _, filter := range *f {
+		s = append(s, "tag:"+filter.Key+"="+filter.Value)
+	}
+	return s
+}
+
+func (f *tagFilters) Set(value string) error {
+	key, tagValue, ok := strings.Cut(strings.TrimPrefix(value, "tag:"), "=")
+	if !strings.HasPrefix(value, "tag:") || !ok || key == "" {
+		return fmt.Errorf("invalid filter %q, expected tag:Key=Value", value)
+	}
+	*f = append(*f, tagFilter{Key: key, Value: tagValue})
+	return nil
+}
+
+// UnmarshalYAML reads the filters from a list of tag:Key=Value strings in the config file
+func (f *tagFilters) UnmarshalYAML(value *yaml.Node) error {
+	var filters []string
+	if err := value.Decode(&filters); err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if err := f.Set(filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether the instance carries a tag matching any of the filters
+func (f tagFilters) matches(instance ec2Types.Instance) bool {
+	for _, filter := range f {
+		for _, tag := range instance.Tags {
+			if aws.ToString(tag.Key) != filter.Key {
+				continue
+			}
+			if ok, _ := path.Match(filter.Value, aws.ToString(tag.Value)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesTags reports whether the tags match any of the filters
+func (f tagFilters) matchesTags(tags map[string]string) bool {
+	for _, filter := range f {
+		value, ok := tags[filter.Key]
+		if !ok {
+			continue
+		}
+		if ok, _ := path.Match(filter.Value, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeInstances drops instances matching any of the exclusion filters
+func excludeInstances(instances []ec2Types.Instance, excludes tagFilters) []ec2Types.Instance {
+	if len(excludes) == 0 {
+		return instances
+	}
+	var result []ec2Types.Instance
+	for _, instance := range instances {
+		if !excludes.matches(instance) {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// forwardSpec is an ssh -L style port forward, localPort:host:remotePort
+type forwardSpec struct {
+	LocalPort  string
+	Host       string
+	RemotePort string
+}
+
+func (f forwardSpec) String() string {
+	return f.LocalPort + ":" + f.Host + ":" + f.RemotePort
+}
+
+func parseForward(value string) (forwardSpec, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || parts[1] == "" {
+		return forwardSpec{}, fmt.Errorf("invalid forward %q, expected localPort:host:remotePort", value)
+	}
+	// local port 0 picks a free port
+	for i, port := range []string{parts[0], parts[2]} {
+		if n, err := strconv.Atoi(port); err != nil || n < i || n > 65535 {
+			return forwardSpec{}, fmt.Errorf("invalid port %q in forward %q", port, value)
+		}
+	}
+	return forwardSpec{LocalPort: parts[0], Host: parts[1], RemotePort: parts[2]}, nil
+}
+
+// forwardSpecs is a repeatable flag of port forwards
+type forwardSpecs []forwardSpec
+
+func (f *forwardSpecs) String() string {
+	return strings.Join(f.values(), ",")
+}
+
+func (f *forwardSpecs) values() []string {
+	var s []string
+	for _, forward := range *f {
+		s = append(s, forward.String())
+	}
+	return s
+}
+
+func (f *forwardSpecs) Set(value string) error {
+	forward, err := parseForward(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, forward)
+	return nil
+}
+
+// sshArgs returns the forwards as ssh -L options. A port forwarding session carries a single port,
+// so several forwards are multiplexed over one ssh connection instead.
+func (f forwardSpecs) sshArgs() []string {
+	var args []string
+	for _, forward := range f {
+		args = append(args, "-L", forward.String())
+	}
+	return args
+}
+
+// assignFreePorts replaces local port 0 with a free ephemeral port and announces it, in a JSON line
+// on stdout for wrapper scripts and in plain words on stderr
+func (f forwardSpecs) assignFreePorts(stdout, stderr io.Writer) error {
+	for i := range f {
+		if f[i].LocalPort != "0" {
+			continue
+		}
+
+		port, err := freeLocalPort()
+		if err != nil {
+			return err
+		}
+		f[i].LocalPort = strconv.Itoa(port)
+
+		line, err := json.Marshal(map[string]any{"local_port": port, "host": f[i].Host, "remote_port": f[i].RemotePort})
+		if err != nil {
+			return fmt.Errorf("failed to marshal forward: %v", err)
+		}
+		fmt.Fprintln(stdout, string(line))
+		fmt.Fprintf(stderr, "Forwarding localhost:%d to %s:%s\n", port, f[i].Host, f[i].RemotePort)
+	}
+	return nil
+}
+
+// freeLocalPort returns a local port that is free right now
+func freeLocalPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free local port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// forwardDocument returns the session document and parameters for the port forward.
+// The session-manager-plugin listens on the local port itself, so no sshd is involved on the instance.
+// Forwards to any other host than the instance itself (e.g. RDS or ElastiCache) use the instance as a jump point.
+func forwardDocument(f forwardSpec) (string, map[string][]string) {
+	if f.Host == "localhost" || f.Host == "127.0.0.1" {
+		return "AWS-StartPortForwardingSession", map[string][]string{
+			"portNumber":      {f.RemotePort},
+			"localPortNumber": {f.LocalPort},
+		}
+	}
+	return "AWS-StartPortForwardingSessionToRemoteHost", map[string][]string{
+		"host":            {f.Host},
+		"portNumber":      {f.RemotePort},
+		"localPortNumber": {f.LocalPort},
+	}
+}
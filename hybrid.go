@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"regexp"
+)
+
+// managedInstanceIDPattern matches IDs of on-prem/hybrid instances registered in Systems Manager
+var managedInstanceIDPattern = regexp.MustCompile(`^mi-[0-9a-f]{17}$`)
+
+// getManagedInstanceDetails looks up a hybrid-activation managed instance in Systems Manager,
+// such instances have no EC2 record (and no AZ), they live in the region they were activated in
+func getManagedInstanceDetails() error {
+	client := ssmClient()
+	ctx, cancel := apiContext()
+	defer cancel()
+	result, err := client.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmTypes.InstanceInformationStringFilter{
+			{
+				Key:    aws.String("InstanceIds"),
+				Values: []string{cfg.InstanceName},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe managed instance: %v", err)
+	}
+	if len(result.InstanceInformationList) == 0 {
+		return fmt.Errorf("managed instance %s is not registered in Systems Manager", cfg.InstanceName)
+	}
+
+	cfg.InstanceID = cfg.InstanceName
+	cfg.InstanceAZ = ""
+	cfg.Region = awsConfig.Region
+	cfg.Hybrid = true
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// markers of the block install manages in ~/.ssh/config, anything outside them is left alone
+const (
+	managedBlockBegin = "# BEGIN ssm-ssh-connect (managed by ssm-ssh-connect install, do not edit)"
+	managedBlockEnd   = "# END ssm-ssh-connect"
+)
+
+// defaultInstallHosts are the hosts the installed block matches: instance IDs of EC2 and managed instances
+const defaultInstallHosts = "i-*,mi-*"
+
+// managedBlock returns the ssh_config block that connects to the hosts through this tool with the profile,
+// sharing connections with --mux
+func managedBlock(executable, profile, hosts string) string {
+	if profile == "" {
+		profile = "-"
+	}
+	return fmt.Sprintf("%s\nMatch host %s\n  ProxyCommand %s %s %%h %%r\n%s%s\n",
+		managedBlockBegin, hosts, shellQuote(executable), shellQuote(profile), controlConfig(), managedBlockEnd)
+}
+
+// withManagedBlock returns the ssh_config with the managed block replaced by block, or appended when there
+// is none yet. An empty block removes the managed one.
+func withManagedBlock(config, block string) (string, error) {
+	begin := strings.Index(config, managedBlockBegin)
+	if begin < 0 {
+		if block == "" {
+			return config, nil
+		}
+		// at the end, so the user's own Host blocks take precedence
+		if config != "" && !strings.HasSuffix(config, "\n") {
+			config += "\n"
+		}
+		if config != "" {
+			config += "\n"
+		}
+		return config + block, nil
+	}
+	end := strings.Index(config[begin:], managedBlockEnd)
+	if end < 0 {
+		return "", fmt.Errorf("the ssm-ssh-connect block has no end marker %q", managedBlockEnd)
+	}
+	end += begin + len(managedBlockEnd)
+	if end < len(config) && config[end] == '\n' {
+		end++
+	}
+	rest := config[end:]
+	if block == "" {
+		// drop the blank line the block was appended after
+		before := config[:begin]
+		if strings.HasSuffix(before, "\n\n") {
+			before = before[:len(before)-1]
+		}
+		return before + rest, nil
+	}
+	return config[:begin] + block + rest, nil
+}
+
+// updateSSHConfig writes the managed block (or removes it, when empty) into the ssh_config at path,
+// keeping a backup of the previous file next to it. It reports whether the file changed.
+func updateSSHConfig(path, block string) (bool, error) {
+	// a symlinked config, e.g. from a dotfiles repository, is updated where it lives
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	config, err := withManagedBlock(string(data), block)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+	if config == string(data) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	if data != nil {
+		if err := os.WriteFile(path+".ssm-ssh-connect.bak", data, 0600); err != nil {
+			return false, fmt.Errorf("failed to back up %s: %v", path, err)
+		}
+	}
+	if err := replaceFile(path, []byte(config), 0600); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// keepaliveSSHArgs returns the ssh options that keep an idle connection alive through aggressive NATs
+// and the Session Manager idle timeout
+func keepaliveSSHArgs(interval time.Duration) []string {
+	if interval <= 0 {
+		return nil
+	}
+	seconds := max(int(interval.Seconds()), 1)
+	return []string{"-o", "ServerAliveInterval=" + strconv.Itoa(seconds), "-o", "ServerAliveCountMax=3"}
+}
+
+// keepForwardAlive briefly connects to the forwarded local port every interval, so the idle port
+// forwarding session carries some traffic. Each connection reaches the remote service and is closed right away.
+func keepForwardAlive(localPort string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", localPort), 5*time.Second)
+			if err != nil {
+				slog.Debug("keepalive connection failed", "error", err)
+				continue
+			}
+			conn.Close()
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keychainGet returns the secret stored in the macOS keychain or, elsewhere, the Secret Service
+// (GNOME Keyring, KWallet) through secret-tool, and whether there is one
+func keychainGet() (string, bool, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", keychainService, "-a", keychainAccount, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", keychainService, "account", keychainAccount)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && keychainNotFound(exitErr.ExitCode(), len(out)+stderr.Len()) {
+		return "", false, nil
+	}
+	if err != nil {
+		// e.g. a locked keychain or a denied access, which must not be taken for a missing key
+		return "", false, fmt.Errorf("%s: %v %s", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	secret := strings.TrimSpace(string(out))
+	return secret, secret != "", nil
+}
+
+// keychainNotFound reports whether the lookup exited the way it does for a missing item: security
+// with errSecItemNotFound (44), secret-tool with 1 and nothing written
+func keychainNotFound(exitCode, written int) bool {
+	if runtime.GOOS == "darwin" {
+		return exitCode == 44
+	}
+	return exitCode == 1 && written == 0
+}
+
+// keychainSet stores the secret in the macOS keychain or the Secret Service
+func keychainSet(secret string) error {
+	// the secret is passed on stdin, keeping it out of the process list: security reads the command
+	// from it in interactive mode, secret-tool the secret itself
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %q -a %q -w %q\n", keychainService, keychainAccount, secret))
+	} else {
+		cmd = exec.Command("secret-tool", "store", "--label", "ssm-ssh-connect cache key", "service", keychainService, "account", keychainAccount)
+		cmd.Stdin = strings.NewReader(secret)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v %s", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	// in interactive mode security exits 0 even when the command failed, and reports it on stderr
+	if runtime.GOOS == "darwin" && stderr.Len() > 0 {
+		return fmt.Errorf("%s: %s", cmd.Path, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
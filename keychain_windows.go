@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// keychainFile keeps the secret protected with DPAPI, which only the same Windows user can unprotect
+func keychainFile() string {
+	return filepath.Join(cfg.StateDir, keychainAccount+".dpapi")
+}
+
+// keychainGet returns the secret stored for the Windows user, and whether there is one
+func keychainGet() (string, bool, error) {
+	data, err := os.ReadFile(keychainFile())
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	secret, err := dpapi(data, windows.CryptUnprotectData)
+	if err != nil {
+		return "", false, err
+	}
+	return string(secret), len(secret) > 0, nil
+}
+
+// keychainSet stores the secret for the Windows user
+func keychainSet(secret string) error {
+	data, err := dpapi([]byte(secret), func(in *windows.DataBlob, _ **uint16, entropy *windows.DataBlob, reserved uintptr, prompt *windows.CryptProtectPromptStruct, flags uint32, out *windows.DataBlob) error {
+		return windows.CryptProtectData(in, nil, entropy, reserved, prompt, flags, out)
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keychainFile(), data, 0600)
+}
+
+// dpapi runs data through CryptProtectData or CryptUnprotectData
+func dpapi(data []byte, crypt func(*windows.DataBlob, **uint16, *windows.DataBlob, uintptr, *windows.CryptProtectPromptStruct, uint32, *windows.DataBlob) error) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no data")
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	var out windows.DataBlob
+	if err := crypt(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
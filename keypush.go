@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+const (
+	// keyValidity is how long EC2 Instance Connect keeps a pushed key authorized
+	keyValidity = 60 * time.Second
+	// keyPushMargin re-pushes a key this long before it lapses, leaving ssh time to authenticate
+	keyPushMargin = 15 * time.Second
+)
+
+// pushedKeys records when each key was last pushed, keyed by instance, user and key fingerprint
+type pushedKeys map[string]time.Time
+
+func pushedKeyID(instanceID, user string, publicKey []byte) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("not a valid SSH public key: %v", err)
+	}
+	return instanceID + "/" + user + "/" + ssh.FingerprintSHA256(key), nil
+}
+
+// due reports whether the key has to be pushed, because it was never pushed or is about to lapse
+func (p pushedKeys) due(id string, now time.Time) bool {
+	return now.Sub(p[id]) >= keyValidity-keyPushMargin
+}
+
+// prune drops entries whose keys have lapsed, keeping the cache small
+func (p pushedKeys) prune(now time.Time) {
+	for id, pushedAt := range p {
+		if now.Sub(pushedAt) >= keyValidity {
+			delete(p, id)
+		}
+	}
+}
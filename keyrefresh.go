@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// keyRefreshInterval is how often the daemon checks whether the keys of active sessions are due,
+// well within keyPushMargin so a key is pushed again before it lapses
+const keyRefreshInterval = 5 * time.Second
+
+// keyRefresh is a set of keys to keep authorized for a user on an instance
+type keyRefresh struct {
+	// id is the same for sessions pushing the same keys for the same user on the same instance
+	id   string
+	push func() error
+}
+
+// keyRefresher pushes a set of keys while sessions hold it
+type keyRefresher struct {
+	holders int
+	stop    chan struct{}
+}
+
+// keyRefresh returns the refresh of the keys for the instance and user in cfg, pushing them with the
+// credentials of the source, as they are now
+func (d *daemon) keyRefresh(source string, publicKeys [][]byte) *keyRefresh {
+	snapshot, snapshotAWS := cfg, awsConfig
+	hash := sha256.New()
+	for _, key := range append([][]byte{[]byte(source), []byte(cfg.InstanceID), []byte(cfg.InstanceUser)}, publicKeys...) {
+		hash.Write(key)
+		hash.Write([]byte{0})
+	}
+	return &keyRefresh{
+		id: hex.EncodeToString(hash.Sum(nil)),
+		push: func() error {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			cfg, awsConfig = snapshot, snapshotAWS
+			return sendPublicKeys(publicKeys)
+		},
+	}
+}
+
+// holdKeys keeps the keys authorized until every session holding them released them, so new ssh
+// connections to the instance, e.g. once ssh's ControlMaster connection was replaced, find them in place
+func (d *daemon) holdKeys(refresh *keyRefresh) (release func()) {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	refresher, ok := d.refreshers[refresh.id]
+	if !ok {
+		refresher = &keyRefresher{stop: make(chan struct{})}
+		d.refreshers[refresh.id] = refresher
+		go refreshKeys(refresh, refresher.stop)
+	}
+	refresher.holders++
+	return func() {
+		d.statsMu.Lock()
+		defer d.statsMu.Unlock()
+		refresher.holders--
+		if refresher.holders == 0 {
+			close(refresher.stop)
+			delete(d.refreshers, refresh.id)
+		}
+	}
+}
+
+// refreshKeys pushes the keys whenever they are about to lapse, until stopped. Pushes of clients
+// connecting meanwhile are recorded in the cache like these, so a key isn't pushed twice.
+func refreshKeys(refresh *keyRefresh, stop <-chan struct{}) {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := refresh.push(); err != nil {
+			slog.Warn("failed to refresh SSH public key", "error", err)
+		}
+	}
+}
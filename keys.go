@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultKeyFiles lists the public keys looked for in ~/.ssh when no identity is given, in order of preference
+var defaultKeyFiles = []string{"id_ed25519.pub", "id_ecdsa.pub", "id_rsa.pub", "id_ed25519_sk.pub", "id_ecdsa_sk.pub"}
+
+// supportedKeyTypes lists the public key types that can be pushed, including FIDO2 security keys (sk-*)
+var supportedKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:        true,
+	ssh.KeyAlgoED25519:    true,
+	ssh.KeyAlgoECDSA256:   true,
+	ssh.KeyAlgoECDSA384:   true,
+	ssh.KeyAlgoECDSA521:   true,
+	ssh.KeyAlgoSKED25519:  true,
+	ssh.KeyAlgoSKECDSA256: true,
+}
+
+// minRSAKeyBits is the smallest RSA key accepted by EC2 Instance Connect
+const minRSAKeyBits = 2048
+
+// checkPublicKey parses an authorized_keys formatted public key and checks that it can be pushed,
+// since EC2 Instance Connect's errors for malformed keys are cryptic
+func checkPublicKey(data []byte) error {
+	if bytes.Contains(data, []byte("PRIVATE KEY")) {
+		return fmt.Errorf("this is a private key, push its .pub file instead")
+	}
+
+	key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return fmt.Errorf("not a valid SSH public key (expected a single \"<type> <base64> [comment]\" line): %v", err)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return fmt.Errorf("file holds more than one public key, use --push-key for additional keys")
+	}
+	if !supportedKeyTypes[key.Type()] {
+		return fmt.Errorf("unsupported SSH key type %s, use ed25519, ecdsa, rsa or their sk- variants", key.Type())
+	}
+
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("RSA key is %d bits, at least %d are required", rsaKey.N.BitLen(), minRSAKeyBits)
+		}
+	}
+	return nil
+}
+
+// publicKeyPath returns the public key file to push via EC2 Instance Connect. Like ssh -i, the identity
+// may name the private key, in which case its .pub counterpart is used. Without an identity, the first
+// of keyFiles found in ~/.ssh is used.
+func publicKeyPath(identity string, keyFiles []string) (string, error) {
+	if identity != "" {
+		return publicKeyPathOf(identity), nil
+	}
+
+	for _, name := range keyFiles {
+		path := expandHome(name)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(homeDir(), ".ssh", path)
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no SSH public key found in ~/.ssh (looked for %s), use --identity", strings.Join(keyFiles, ", "))
+}
+
+// publicKeyPathOf returns the .pub counterpart of a key path, expanding a leading ~
+func publicKeyPathOf(path string) string {
+	path = expandHome(path)
+	if !strings.HasSuffix(path, ".pub") {
+		path += ".pub"
+	}
+	return path
+}
+
+// homeDir returns the user's home directory, %USERPROFILE% on Windows
+func homeDir() string {
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		return homeDir() + path[1:]
+	}
+	return path
+}
+
+// pathList is a repeatable flag of file paths
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) values() []string {
+	return *l
+}
+
+func (l *pathList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// readPublicKeys returns all public keys to push: the user's own key, followed by any additional
+// keys from --push-key or the config file's push_keys (e.g. a pairing partner's or a backup key)
+func readPublicKeys() ([][]byte, error) {
+	publicKey, err := readPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKeys := [][]byte{publicKey}
+
+	for _, path := range cfg.PushKeys {
+		publicKey, err := os.ReadFile(publicKeyPathOf(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH public key: %v", err)
+		}
+		if err := checkPublicKey(publicKey); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, nil
+}
+
+// readPublicKey returns the public key to push, taken from the ssh-agent with --agent or from a key file otherwise
+func readPublicKey() ([]byte, error) {
+	if cfg.Agent {
+		return agentPublicKey()
+	}
+
+	keyPath, err := publicKeyPath(cfg.Identity, cfg.KeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("using SSH public key", "path", keyPath)
+
+	publicKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH public key: %v", err)
+	}
+	if err := checkPublicKey(publicKey); err != nil {
+		return nil, fmt.Errorf("%s: %v", keyPath, err)
+	}
+	return publicKey, nil
+}
+
+// agentPublicKey returns the public half of a key held by the ssh-agent at SSH_AUTH_SOCK,
+// so agent-only and hardware-backed keys work without key files on disk.
+// If the agent holds several keys, the user picks one (or the first is used without a terminal).
+func agentPublicKey() ([]byte, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set, no ssh-agent to take the key from")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("ssh-agent holds no keys")
+	}
+
+	selected := 0
+	if len(keys) > 1 {
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			items[i] = fmt.Sprintf("%s %s %s", key.Type(), ssh.FingerprintSHA256(key), key.Comment)
+		}
+		selected, err = pick("ssh-agent holds several keys, which one should be pushed?", items)
+		if errors.Is(err, errNoTTY) {
+			selected = 0
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Info("using ssh-agent key", "comment", keys[selected].Comment, "fingerprint", ssh.FingerprintSHA256(keys[selected]))
+	return ssh.MarshalAuthorizedKey(keys[selected]), nil
+}
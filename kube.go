@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"net/url"
+	"strings"
+)
+
+// eksEndpointHost returns the host name of the EKS cluster's API endpoint. The cluster is given by name,
+// which is looked up in the instance's region, or by its endpoint (anything with a dot, cluster names have none).
+func eksEndpointHost(cluster string) (string, error) {
+	if strings.Contains(cluster, ".") {
+		return endpointHost(cluster)
+	}
+
+	client := eks.NewFromConfig(awsConfig, func(o *eks.Options) {
+		o.Region = cfg.Region
+	})
+	ctx, cancel := apiContext()
+	defer cancel()
+	result, err := client.DescribeCluster(ctx, &eks.DescribeClusterInput{Name: aws.String(cluster)})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe EKS cluster %q: %v", cluster, err)
+	}
+	if result.Cluster == nil || aws.ToString(result.Cluster.Endpoint) == "" {
+		return "", fmt.Errorf("EKS cluster %q has no endpoint yet", cluster)
+	}
+	return endpointHost(aws.ToString(result.Cluster.Endpoint))
+}
+
+// endpointHost returns the host of an endpoint given as URL or bare host name
+func endpointHost(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	return u.Hostname(), nil
+}
+
+// kubeHint tells how to point kubectl at the forwarded API endpoint; the certificate is issued for the
+// endpoint's host name, so TLS verification needs it as server name
+func kubeHint(localPort, host string) string {
+	return fmt.Sprintf("Use: kubectl --server https://localhost:%s --tls-server-name %s ...", localPort, host)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// output formats of list
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// listInstances prints all running instances of the profile with their SSM ping status
+func listInstances(w io.Writer, output string) error {
+	rows, err := runningInstances()
+	if err != nil {
+		return err
+	}
+	return writeInstances(w, rows, output)
+}
+
+// runningInstances returns all running instances of the profile with their SSM ping status, sorted by name
+func runningInstances() ([]instanceRow, error) {
+	ec2Client := ec2Client()
+	var instances []ec2Types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []ec2Types.Filter{
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"running"},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		ctx, cancel := apiContext()
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %v", err)
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+
+	pingStatus, err := getPingStatuses()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instanceName(instances[i]) < instanceName(instances[j])
+	})
+
+	rows := make([]instanceRow, len(instances))
+	for i, instance := range instances {
+		status, ok := pingStatus[aws.ToString(instance.InstanceId)]
+		if !ok {
+			status = "NotRegistered"
+		}
+		tags := make(map[string]string, len(instance.Tags))
+		for _, tag := range instance.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		rows[i] = instanceRow{
+			Name:             instanceName(instance),
+			InstanceID:       aws.ToString(instance.InstanceId),
+			AvailabilityZone: aws.ToString(instance.Placement.AvailabilityZone),
+			PrivateIP:        aws.ToString(instance.PrivateIpAddress),
+			SSMStatus:        status,
+			Tags:             tags,
+		}
+	}
+	return rows, nil
+}
+
+// instanceRow is a line of the instance list
+type instanceRow struct {
+	Name             string            `json:"name"`
+	InstanceID       string            `json:"instance_id"`
+	AvailabilityZone string            `json:"availability_zone"`
+	PrivateIP        string            `json:"private_ip"`
+	SSMStatus        string            `json:"ssm_status"`
+	Tags             map[string]string `json:"tags,omitempty"`
+}
+
+// writeInstances writes the instance list as a table, or as a JSON array for other tools
+func writeInstances(w io.Writer, rows []instanceRow, output string) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tINSTANCE ID\tAZ\tPRIVATE IP\tSSM STATUS")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", row.Name, row.InstanceID, row.AvailabilityZone, row.PrivateIP, row.SSMStatus)
+	}
+	return tw.Flush()
+}
+
+// resolution is what the resolve command prints for the target
+type resolution struct {
+	Target           string `json:"target"`
+	InstanceID       string `json:"instance_id"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	Region           string `json:"region"`
+	Platform         string `json:"platform,omitempty"`
+	Hybrid           bool   `json:"hybrid,omitempty"`
+}
+
+// writeResolution writes the resolved instance of the target as JSON
+func writeResolution(w io.Writer) error {
+	return json.NewEncoder(w).Encode(resolution{
+		Target:           cfg.InstanceName,
+		InstanceID:       cfg.InstanceID,
+		AvailabilityZone: cfg.InstanceAZ,
+		Region:           cfg.Region,
+		Platform:         cfg.Platform,
+		Hybrid:           cfg.Hybrid,
+	})
+}
+
+// getPingStatuses returns SSM agent ping status of all instances registered in Systems Manager
+func getPingStatuses() (map[string]string, error) {
+	client := ssmClient()
+	statuses := map[string]string{}
+	paginator := ssm.NewDescribeInstanceInformationPaginator(client, &ssm.DescribeInstanceInformationInput{})
+	for paginator.HasMorePages() {
+		ctx, cancel := apiContext()
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instance information: %v", err)
+		}
+		for _, info := range page.InstanceInformationList {
+			statuses[aws.ToString(info.InstanceId)] = string(info.PingStatus)
+		}
+	}
+	return statuses, nil
+}
+
+// getPingStatus returns SSM agent ping status of the instance, or an empty string if it is not registered
+func getPingStatus(instanceID string) (string, error) {
+	client := ssmClient()
+	ctx, cancel := apiContext()
+	defer cancel()
+	result, err := client.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmTypes.InstanceInformationStringFilter{
+			{
+				Key:    aws.String("InstanceIds"),
+				Values: []string{instanceID},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe instance information: %w", err)
+	}
+	if len(result.InstanceInformationList) == 0 {
+		return "", nil
+	}
+	return string(result.InstanceInformationList[0].PingStatus), nil
+}
+
+// checkSSMOnline makes sure the SSM agent on the target can take a session, so we fail with a clear
+// message instead of an opaque TargetNotConnected error from session-manager-plugin
+func checkSSMOnline() error {
+	status, err := getPingStatus(cfg.InstanceID)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case string(ssmTypes.PingStatusOnline):
+		return nil
+	case "":
+		return fmt.Errorf("instance %s is not registered in Systems Manager (is the SSM agent installed and allowed by the instance profile?)", cfg.InstanceID)
+	default:
+		return fmt.Errorf("SSM agent on instance %s is offline (ping status: %s)", cfg.InstanceID, status)
+	}
+}
+
+// instanceName returns the value of the instance's Name tag
+func instanceName(instance ec2Types.Instance) string {
+	for _, tag := range instance.Tags {
+		if aws.ToString(tag.Key) == "Name" {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lock takes an exclusive lock on the lock file, waiting for a concurrent holder to release it.
+// The lock goes with the holder's process, so a crashed invocation leaves none behind.
+func lock(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	handle := windows.Handle(f.Fd())
+	if err := windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return func() {
+		windows.UnlockFileEx(handle, 0, 1, 0, &windows.Overlapped{})
+		f.Close()
+	}, nil
+}
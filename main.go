@@ -1,89 +1,813 @@
 package main
 
 import (
-	"context"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+	"io"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type Config struct {
-	AppHome      string `json:"-"`
-	AwsProfile   string `json:"-"`
-	Region       string `json:"region"`
-	InstanceName string `json:"-"`
-	InstanceID   string `json:"instance_id"`
-	InstanceAZ   string `json:"instance_az"`
-	InstanceUser string `json:"-"`
+	ConfigDir      string             `json:"-"`
+	StateDir       string             `json:"-"`
+	AwsProfile     string             `json:"-"`
+	Region         string             `json:"region"`
+	InstanceName   string             `json:"-"`
+	InstanceID     string             `json:"instance_id"`
+	CachedName     string             `json:"name,omitempty"` // the instance name of a cache entry, for shell completion
+	FromCache      bool               `json:"-"`              // the instance was loaded from the cache and may be stale
+	InstanceAZ     string             `json:"instance_az"`
+	Hybrid         bool               `json:"hybrid,omitempty"`
+	Platform       string             `json:"platform,omitempty"`
+	InstanceUser   string             `json:"-"`
+	StartStopped   bool               `json:"-"`
+	AllRegions     bool               `json:"-"`
+	Excludes       tagFilters         `json:"-"`
+	Tags           tagFilters         `json:"-"`
+	VpcID          string             `json:"-"`
+	SubnetID       string             `json:"-"`
+	PlatformOnly   string             `json:"-"`
+	SSOLogin       bool               `json:"-"`
+	RoleARN        string             `json:"-"`
+	ExternalID     string             `json:"-"`
+	RoleSession    string             `json:"-"`
+	RegionFlag     string             `json:"-"`
+	FIPS           bool               `json:"-"`
+	Proxy          string             `json:"-"`
+	Identity       string             `json:"-"`
+	KeyFiles       []string           `json:"-"`
+	Agent          bool               `json:"-"`
+	PushKeys       pathList           `json:"-"`
+	Forwards       forwardSpecs       `json:"-"`
+	SocksPort      string             `json:"-"`
+	Shell          bool               `json:"-"`
+	Command        string             `json:"-"`
+	Document       string             `json:"-"`
+	Port           string             `json:"-"`
+	Reconnect      bool               `json:"-"`
+	Keepalive      time.Duration      `json:"-"`
+	MaxDuration    time.Duration      `json:"-"`
+	IdleTimeout    time.Duration      `json:"-"`
+	RDPPort        string             `json:"-"`
+	LaunchRDP      bool               `json:"-"`
+	DBClient       string             `json:"-"`
+	DBUser         string             `json:"-"`
+	DBName         string             `json:"-"`
+	DBEndpoint     string             `json:"-"`
+	Reason         string             `json:"-"`
+	Mux            bool               `json:"-"`
+	KubePort       string             `json:"-"`
+	KubeCluster    string             `json:"-"`
+	CacheTTL       time.Duration      `json:"-"`
+	Retries        int                `json:"-"`
+	APITimeout     time.Duration      `json:"-"`
+	ConnectTimeout time.Duration      `json:"-"`
+	CacheDir       string             `json:"-"`
+	NoCache        bool               `json:"-"`
+	EncryptCache   bool               `json:"-"`
+	SharedCache    string             `json:"-"`
+	Resolver       string             `json:"-"`
+	PluginPath     string             `json:"-"`
+	LogLevel       string             `json:"-"`
+	DryRun         bool               `json:"-"`
+	Banner         bool               `json:"-"`
+	Output         string             `json:"-"`
+	Parameters     documentParameters `json:"-"`
+
+	// custom service endpoints, e.g. VPC interface endpoints or localstack
+	EC2Endpoint                string `json:"-"`
+	S3Endpoint                 string `json:"-"`
+	EC2InstanceConnectEndpoint string `json:"-"`
+	SSMEndpoint                string `json:"-"`
 }
 
 var cfg Config
 var awsConfig aws.Config
 
+// instanceIDPattern matches EC2 instance IDs in both short (8) and long (17) formats
+var instanceIDPattern = regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`)
+
+// privateDNSPattern matches EC2 private DNS names, both IP-based (ip-10-0-4-12.eu-west-1.compute.internal,
+// ip-10-0-4-12.ec2.internal in us-east-1) and resource-based (i-0123456789abcdef0.eu-west-1.compute.internal)
+var privateDNSPattern = regexp.MustCompile(`^(ip-[0-9-]+|i-[0-9a-f]+)(\.[a-z0-9-]+)?\.(compute|ec2)\.internal$`)
+
 func main() {
-	if len(os.Args) != 4 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <aws-profile> <instance-name> <instance-user>\n", os.Args[0])
+	flag.BoolVar(&cfg.StartStopped, "start", false, "start the instance if it is stopped and wait until it is ready")
+	flag.BoolVar(&cfg.AllRegions, "all-regions", false, "search all enabled regions when the target is not found in the profile's region (env SSM_SSH_CONNECT_ALL_REGIONS=1)")
+	flag.BoolVar(&cfg.SSOLogin, "sso-login", false, "run aws sso login and retry when the AWS SSO session has expired")
+	flag.StringVar(&cfg.VpcID, "vpc", "", "only consider instances in this VPC")
+	flag.StringVar(&cfg.SubnetID, "subnet", "", "only consider instances in this subnet")
+	flag.StringVar(&cfg.PlatformOnly, "platform", "", "only consider instances of this platform (linux or windows)")
+	flag.StringVar(&cfg.RoleARN, "role-arn", "", "assume this role on top of the profile before looking up the instance")
+	flag.StringVar(&cfg.ExternalID, "external-id", "", "external ID to pass when assuming --role-arn")
+	flag.StringVar(&cfg.RoleSession, "role-session-name", "ssm-ssh-connect", "session name to use when assuming --role-arn")
+	flag.StringVar(&cfg.RegionFlag, "region", "", "look up the instance in this region instead of the profile's default (env SSM_SSH_CONNECT_REGION)")
+	flag.BoolVar(&cfg.FIPS, "fips", false, "use FIPS endpoints for EC2, EC2 Instance Connect and SSM (env SSM_SSH_CONNECT_FIPS=1)")
+	flag.StringVar(&cfg.Proxy, "proxy", "", "send AWS API calls and the session stream through this proxy (defaults to HTTPS_PROXY)")
+	flag.StringVar(&cfg.Identity, "identity", os.Getenv("SSM_SSH_CONNECT_KEY"), "SSH key to push via EC2 Instance Connect, private or .pub (env SSM_SSH_CONNECT_KEY, default: first of ~/.ssh/id_ed25519.pub, id_ecdsa.pub, id_rsa.pub, id_ed25519_sk.pub, id_ecdsa_sk.pub)")
+	flag.StringVar(&cfg.Identity, "i", os.Getenv("SSM_SSH_CONNECT_KEY"), "shorthand for --identity")
+	flag.BoolVar(&cfg.Agent, "agent", false, "push a key held by the ssh-agent (SSH_AUTH_SOCK) instead of a key file")
+	flag.Var(&cfg.PushKeys, "push-key", "additionally push this public key, e.g. a pairing partner's, repeatable")
+	flag.Var(&cfg.Forwards, "L", "with forward: forward the local port through the instance, as localPort:host:remotePort, repeatable")
+	flag.Var(&cfg.Forwards, "forward", "same as -L")
+	flag.StringVar(&cfg.RDPPort, "rdp-port", "3389", "with rdp: local port to forward to the instance's RDP port, 0 picks a free one")
+	flag.BoolVar(&cfg.LaunchRDP, "launch", false, "with rdp: open the local RDP client once the tunnel is up")
+	flag.StringVar(&cfg.DBClient, "db-client", "", "with db: client to run, psql, mysql or redis-cli (default: from the endpoint port)")
+	flag.StringVar(&cfg.DBUser, "db-user", "", "with db: database user")
+	flag.StringVar(&cfg.DBName, "db-name", "", "with db: database to connect to (for redis-cli the database number)")
+	flag.StringVar(&cfg.KubePort, "kube-port", "0", "with kube: local port to forward to the cluster's API endpoint, 0 picks a free one")
+	flag.StringVar(&cfg.SocksPort, "D", "1080", "with socks: local SOCKS5 port")
+	flag.BoolVar(&cfg.Mux, "mux", false, "share one ssh connection, and SSM session, per host between ssh connections with ssh's ControlMaster, for install, ssh-config and the commands running ssh")
+	flag.BoolVar(&cfg.Reconnect, "reconnect", false, "with forward or shell: restart the session when the connection drops")
+	flag.DurationVar(&cfg.Keepalive, "keepalive", 0, "keep idle sessions alive: ssh ServerAliveInterval for wrapped ssh, periodic connections for a port forward (e.g. 60s)")
+	flag.DurationVar(&cfg.MaxDuration, "max-duration", 0, "terminate the session after this long (e.g. 1h)")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 0, "terminate the session after this long without traffic (e.g. 15m)")
+	flag.StringVar(&cfg.Reason, "reason", "", "reason for the session, e.g. a ticket; sent with the session and written to the local audit log")
+	flag.StringVar(&cfg.Port, "port", "22", "sshd port on the instance, pass %p from ssh_config to follow the Port setting")
+	flag.StringVar(&cfg.Document, "document", "", "start the SSH session with this session document instead of AWS-StartSSHSession")
+	flag.Var(&cfg.Parameters, "parameter", "session document parameter as key=value, repeatable")
+	flag.IntVar(&cfg.Retries, "retries", defaultRetries, "how often AWS API calls failing with a transient error (throttling, timeouts, 5xx) are retried, with jittered exponential backoff (env SSM_SSH_CONNECT_RETRIES)")
+	flag.DurationVar(&cfg.APITimeout, "api-timeout", defaultAPITimeout, "give up on an AWS API call, or the credential provider, after this long, 0 waits forever (env SSM_SSH_CONNECT_API_TIMEOUT)")
+	flag.DurationVar(&cfg.ConnectTimeout, "connect-timeout", 0, "give up when the session is not up after this long, prompts included, e.g. 1m (env SSM_SSH_CONNECT_CONNECT_TIMEOUT, default none)")
+	flag.DurationVar(&cfg.CacheTTL, "cache-ttl", defaultCacheTTL, "how long resolved instances are cached, 0 disables the cache (env SSM_SSH_CONNECT_CACHE_TTL)")
+	flag.BoolVar(&cfg.NoCache, "no-cache", false, "resolve the instance afresh instead of using the cache, e.g. right after a fleet was replaced (env SSM_SSH_CONNECT_NO_CACHE=1)")
+	flag.BoolVar(&cfg.EncryptCache, "encrypt-cache", false, "encrypt cached instances and credentials with a key kept in the OS keychain (env SSM_SSH_CONNECT_ENCRYPT_CACHE=1)")
+	flag.StringVar(&cfg.SharedCache, "shared-cache", "", "also cache resolved instances in an S3 prefix shared by the team, as s3://bucket/prefix (one prefix per account)")
+	flag.StringVar(&cfg.Resolver, "resolver", "", "where targets are looked up: ec2 (DescribeInstances) or ssm (Systems Manager's inventory, needs no EC2 permissions) (env SSM_SSH_CONNECT_RESOLVER, default ec2)")
+	flag.StringVar(&cfg.Output, "output", outputText, "with list, cache show, status and sessions: output format, text or json")
+	flag.BoolVar(&cfg.Banner, "banner", false, "print the instance's account, ID, Name, AZ, private IP and launch time to stderr before connecting (env SSM_SSH_CONNECT_BANNER=1)")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "resolve the instance and print what would be run, without starting a session or pushing a key")
+	flag.StringVar(&cfg.CacheDir, "cache-dir", "", "directory of the instance and credentials cache (env SSM_SSH_CONNECT_CACHE_DIR, default $XDG_CACHE_HOME/ssm-ssh-connect)")
+	flag.StringVar(&cfg.PluginPath, "plugin-path", os.Getenv("SSM_SSH_CONNECT_PLUGIN"), "path or command name of the session-manager-plugin binary (env SSM_SSH_CONNECT_PLUGIN or SSM_SSH_CONNECT_PLUGIN_PATH, default: looked up on the PATH and in common paths)")
+	flag.StringVar(&cfg.LogLevel, "log-level", "", "level of the log file: debug, info, warn or error (env SSM_SSH_CONNECT_LOG_LEVEL, default error)")
+	flag.Var(&cfg.Tags, "tag", "with ssh-config and cache warm: only instances carrying the tag, as tag:Key=Value (value may be a glob), repeatable")
+	flag.Var(&cfg.Excludes, "exclude", "skip instances carrying the tag, as tag:Key=Value (value may be a glob), repeatable")
+	flag.Usage = func() {
+		usage(os.Stderr, os.Args[0], "")
+	}
+	// every flag can also be set in the environment, the command line takes precedence
+	if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	cfg.AwsProfile = os.Args[1]
-	cfg.InstanceName = os.Args[2]
-	cfg.InstanceUser = os.Args[3]
+	// the completion scripts ask for candidates, before any flag parsing of the partial command line
+	if len(os.Args) > 1 && os.Args[1] == "__complete" {
+		dirs := defaultDirs()
+		for _, candidate := range completions(os.Args[2:], awsConfigFiles(), dirs.Config, cmp.Or(cfg.CacheDir, dirs.Cache)) {
+			fmt.Println(candidate)
+		}
+		return
+	}
+	flag.Parse()
 
-	cfg.AppHome = os.Getenv("HOME") + "/.ssm-ssh-connect"
+	// subcommands accept flags after the command name too
+	command := ""
+	if c, ok := findCommand(flag.Arg(0)); ok {
+		command = c.name
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	switch command {
+	case "help":
+		usage(os.Stdout, os.Args[0], flag.Arg(0))
+		return
+	case "completion":
+		script, err := completionScript(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(script)
+		return
+	case "connect":
+		// the explicit name of the default
+		command = ""
+	}
 
-	// Set up logging
-	err := os.MkdirAll(cfg.AppHome, 0750)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create app home directory: %v\n", err)
+	// run, cp, sftp and db take the arguments of the remote command, scp, sftp or the database client after --
+	targetArgs, passArgs := flag.Args(), []string(nil)
+	// sessions terminate takes the sessions to terminate
+	var sessionIDs []string
+	if i := slices.Index(targetArgs, "--"); i >= 0 && (command == "run" || command == "cp" || command == "sftp" || command == "db") {
+		targetArgs, passArgs = targetArgs[:i], targetArgs[i+1:]
+	}
+	if command != "db" {
+		cfg.Command = strings.Join(passArgs, " ")
+	}
+	// commands that log in to the instance with ssh and need an OS user
+	// (several port forwards share one ssh connection)
+	sshCommand := command == "" || command == "socks" || command == "cp" || command == "sftp" ||
+		(command == "forward" && len(cfg.Forwards) > 1)
+
+	if err := validatePlatform(cfg.PlatformOnly); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(cfg.Reason) > maxReasonLength {
+		fmt.Fprintf(os.Stderr, "--reason is longer than %d characters\n", maxReasonLength)
+		os.Exit(1)
+	}
+	if cfg.Output != outputText && cfg.Output != outputJSON {
+		fmt.Fprintf(os.Stderr, "invalid output format %q, expected text or json\n", cfg.Output)
+		os.Exit(1)
+	}
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		fmt.Fprintf(os.Stderr, "invalid port %q\n", cfg.Port)
+		os.Exit(1)
+	}
+
+	switch {
+	case command != "forward" && len(cfg.Forwards) > 0:
+		fmt.Fprintln(os.Stderr, "-L/--forward is only supported by the forward command")
+		os.Exit(1)
+	case cfg.Mux && runtime.GOOS == "windows":
+		fmt.Fprintln(os.Stderr, "--mux needs ssh's ControlMaster, which Windows OpenSSH doesn't support")
+		os.Exit(1)
+	case cfg.Mux && !slices.Contains(muxCommands, command):
+		fmt.Fprintln(os.Stderr, "--mux is only supported by install, ssh-config and the commands running ssh, the ProxyCommand can't share its session")
+		os.Exit(1)
+	case (command == "version" || command == "self-update" || command == "uninstall" || command == "daemon") && flag.NArg() == 0:
+	case command == "cache" && flag.NArg() == 1 && flag.Arg(0) == "show":
+	case command == "status" && flag.NArg() == 0:
+	case command == "sessions" && flag.NArg() <= 1 && flag.Arg(0) != "terminate":
+		cfg.AwsProfile = flag.Arg(0)
+	case command == "sessions" && flag.Arg(0) == "terminate":
+		cfg.AwsProfile, sessionIDs = splitSessionArgs(flag.Args()[1:])
+	case command == "cache" && flag.NArg() <= 3 && flag.Arg(0) == "warm":
+		cfg.AwsProfile = flag.Arg(1)
+	case command == "install" && flag.NArg() <= 2:
+		cfg.AwsProfile = flag.Arg(0)
+	case (command == "list" || command == "tui" || command == "ssh-config") && flag.NArg() == 0:
+	case (command == "list" || command == "tui" || command == "ssh-config") && flag.NArg() == 1:
+		cfg.AwsProfile = flag.Arg(0)
+	case command == "forward" && len(cfg.Forwards) == 0:
+		fmt.Fprintln(os.Stderr, "forward needs -L/--forward")
 		os.Exit(1)
+	case command == "run" && cfg.Command == "":
+		fmt.Fprintln(os.Stderr, "run needs a command after --")
+		os.Exit(1)
+	case command == "run" && len(targetArgs) == 1:
+		cfg.InstanceName = targetArgs[0]
+	case command == "run" && len(targetArgs) == 2:
+		cfg.AwsProfile = targetArgs[0]
+		cfg.InstanceName = targetArgs[1]
+	case (command == "forward" || command == "rdp" || command == "resolve" || command == "shell") && !sshCommand && flag.NArg() == 1:
+		cfg.InstanceName = flag.Arg(0)
+	case (command == "forward" || command == "rdp" || command == "resolve" || command == "shell") && !sshCommand && flag.NArg() == 2:
+		cfg.AwsProfile = flag.Arg(0)
+		cfg.InstanceName = flag.Arg(1)
+	case command == "db" && len(targetArgs) == 2:
+		cfg.InstanceName = targetArgs[0]
+		cfg.DBEndpoint = targetArgs[1]
+	case command == "db" && len(targetArgs) == 3:
+		cfg.AwsProfile = targetArgs[0]
+		cfg.InstanceName = targetArgs[1]
+		cfg.DBEndpoint = targetArgs[2]
+	case command == "kube" && flag.NArg() == 2:
+		cfg.InstanceName = flag.Arg(0)
+		cfg.KubeCluster = flag.Arg(1)
+	case command == "kube" && flag.NArg() == 3:
+		cfg.AwsProfile = flag.Arg(0)
+		cfg.InstanceName = flag.Arg(1)
+		cfg.KubeCluster = flag.Arg(2)
+	case command == "cp" && len(passArgs) < 2:
+		fmt.Fprintln(os.Stderr, "cp needs scp arguments after --, with remote paths written as :path")
+		os.Exit(1)
+	case sshCommand && len(targetArgs) == 1:
+		cfg.InstanceName = targetArgs[0]
+	case sshCommand && len(targetArgs) == 2:
+		cfg.InstanceName = targetArgs[0]
+		cfg.InstanceUser = targetArgs[1]
+	case sshCommand && len(targetArgs) == 3:
+		cfg.AwsProfile = targetArgs[0]
+		cfg.InstanceName = targetArgs[1]
+		cfg.InstanceUser = targetArgs[2]
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if profile := os.Getenv("SSM_SSH_CONNECT_PROFILE"); cfg.AwsProfile == "" && profile != "" {
+		cfg.AwsProfile = profile
+	}
+	// the config file's profile applies only when no profile was given at all
+	defaultProfile := cfg.AwsProfile == ""
+	if cfg.AwsProfile == "-" {
+		cfg.AwsProfile = ""
+	}
+	// rdp is a port forward to the instance's RDP port
+	rdp := command == "rdp"
+	if rdp {
+		cfg.Forwards = forwardSpecs{{LocalPort: cfg.RDPPort, Host: "localhost", RemotePort: "3389"}}
+		command = "forward"
+	}
+	// kube is a port forward to the EKS cluster's API endpoint, which is looked up once the region is known
+	kube := command == "kube"
+	if kube {
+		cfg.Forwards = forwardSpecs{{LocalPort: cfg.KubePort, RemotePort: "443"}}
+		command = "forward"
+	}
+	// db is a port forward to the database endpoint on a free local port, with the client attached
+	db := command == "db"
+	if db {
+		host, port, client, err := parseDBEndpoint(cfg.DBEndpoint, cfg.DBClient)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg.DBClient = client
+		cfg.Forwards = forwardSpecs{{LocalPort: "0", Host: host, RemotePort: port}}
+		command = "forward"
+	}
+	// without ssh on the other end of stdin, a plain shell is all that makes sense
+	cfg.Shell = command == "shell" || (command == "" && isTerminal(os.Stdin))
+
+	dirs := defaultDirs()
+	cfg.ConfigDir, cfg.StateDir = dirs.Config, dirs.State
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = dirs.Cache
+	}
+	dirs.Cache = cfg.CacheDir
+	cfg.EC2Endpoint = os.Getenv("SSM_SSH_CONNECT_EC2_ENDPOINT")
+	cfg.EC2InstanceConnectEndpoint = os.Getenv("SSM_SSH_CONNECT_EC2_INSTANCE_CONNECT_ENDPOINT")
+	cfg.SSMEndpoint = os.Getenv("SSM_SSH_CONNECT_SSM_ENDPOINT")
+	cfg.S3Endpoint = os.Getenv("SSM_SSH_CONNECT_S3_ENDPOINT")
+
+	// files used to live in one directory in the home directory
+	if err := migrateLegacyHome(legacyHome(), dirs); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to migrate %s: %v\n", legacyHome(), err)
+	}
+
+	// Set up logging
+	for _, dir := range []string{cfg.ConfigDir, cfg.CacheDir, cfg.StateDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create directory: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	// remove log file if its size is greater than 1MB to avoid filling up disk space
-	s, err := os.Stat(cfg.AppHome + "/ssm-ssh-connect.log")
+	s, err := os.Stat(cfg.StateDir + "/ssm-ssh-connect.log")
 	if err == nil && s.Size() > 1024*1024 {
-		os.Remove(cfg.AppHome + "/ssm-ssh-connect.log")
+		os.Remove(cfg.StateDir + "/ssm-ssh-connect.log")
 	}
 
-	logFile, err := os.OpenFile(cfg.AppHome+"/ssm-ssh-connect.log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	logFile, err := os.OpenFile(cfg.StateDir+"/ssm-ssh-connect.log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to open log file: %v\n", err)
 		os.Exit(1)
 	}
 	defer logFile.Close()
 
+	// config file defaults apply where no flag or environment variable was given
+	fileConfig, err := loadConfigFile(cfg.ConfigDir + "/config.yaml")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// an alias stands for the instance name, and for the profile and user unless given
+	if alias, ok := fileConfig.Aliases[cfg.InstanceName]; ok {
+		alias.apply(&cfg, !defaultProfile)
+		if alias.Profile != "" {
+			defaultProfile = false
+		}
+	}
+	host := fileConfig.host(cfg.InstanceName)
+	if cfg.Identity == "" {
+		cfg.Identity = host.Identity
+	}
+	if cfg.Identity == "" {
+		cfg.Identity = fileConfig.Identity
+	}
+	if defaultProfile && os.Getenv("AWS_PROFILE") == "" {
+		cfg.AwsProfile = fileConfig.Profile
+	}
+	if cfg.InstanceUser == "" || cfg.InstanceUser == "-" {
+		cfg.InstanceUser = fileConfig.user(cfg.InstanceName, profileLabel(&cfg))
+	} else if mapped := fileConfig.user(cfg.InstanceName, profileLabel(&cfg)); mapped != "" && localUser(cfg.InstanceUser) {
+		// %r of an ssh_config entry without a User
+		cfg.InstanceUser = mapped
+	}
+	if cfg.RegionFlag == "" {
+		cfg.RegionFlag = fileConfig.Region
+	}
+	// 0 disables the cache, so the flag's default can't tell whether a TTL was given
+	if !flagGiven("cache-ttl") && fileConfig.CacheTTL != nil {
+		cfg.CacheTTL = *fileConfig.CacheTTL
+	}
+	if cfg.CacheTTL < 0 {
+		fmt.Fprintln(os.Stderr, "--cache-ttl must not be negative")
+		os.Exit(1)
+	}
+	// 0 disables retries, as with the cache TTL
+	if !flagGiven("retries") && fileConfig.Retries != nil {
+		cfg.Retries = *fileConfig.Retries
+	}
+	if cfg.Retries < 0 {
+		fmt.Fprintln(os.Stderr, "--retries must not be negative")
+		os.Exit(1)
+	}
+	// 0 waits forever, as with the retries
+	if !flagGiven("api-timeout") && fileConfig.APITimeout != nil {
+		cfg.APITimeout = *fileConfig.APITimeout
+	}
+	if !flagGiven("connect-timeout") && fileConfig.ConnectTimeout != nil {
+		cfg.ConnectTimeout = *fileConfig.ConnectTimeout
+	}
+	if cfg.APITimeout < 0 || cfg.ConnectTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "--api-timeout and --connect-timeout must not be negative")
+		os.Exit(1)
+	}
+	if cfg.PluginPath == "" {
+		cfg.PluginPath = fileConfig.PluginPath
+	}
+	cfg.PluginPath = expandHome(cfg.PluginPath)
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = fileConfig.LogLevel
+	}
+	if command == "version" {
+		plugin, err := pluginVersion()
+		if err != nil {
+			plugin = err.Error()
+		} else if olderVersion(plugin, minPluginVersion) {
+			plugin += fmt.Sprintf(" (older than %s, please update it)", minPluginVersion)
+		}
+		v, c, d := buildInfo()
+		fmt.Print(versionText(v, c, d, plugin))
+		return
+	}
+	if command == "install" || command == "uninstall" {
+		sshConfigPath := homeDir() + "/.ssh/config"
+		block := ""
+		if command == "install" {
+			executable, err := os.Executable()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to find own executable: %v\n", err)
+				os.Exit(1)
+			}
+			block = managedBlock(executable, cfg.AwsProfile, cmp.Or(flag.Arg(1), defaultInstallHosts))
+		}
+		changed, err := updateSSHConfig(sshConfigPath, block)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if changed {
+			fmt.Printf("Updated %s, the previous version is in %s.ssm-ssh-connect.bak\n", sshConfigPath, sshConfigPath)
+		} else {
+			fmt.Printf("%s is up to date\n", sshConfigPath)
+		}
+		return
+	}
+	if command == "cache" && flag.Arg(0) == "show" {
+		db, err := readCacheDB(cfg.CacheDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		now := time.Now()
+		if err := writeCacheRows(os.Stdout, cacheRows(db, cfg.CacheTTL, now), cfg.Output, now); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write cache: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == "status" {
+		status, err := queryDaemonStatus(daemonSocket(cfg.StateDir))
+		if errors.Is(err, errNoDaemon) {
+			fmt.Fprintf(os.Stderr, "No daemon is running, start one with: %s daemon\n", os.Args[0])
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := writeDaemonStatus(os.Stdout, status, cfg.Output, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write status: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if sshCommand && cfg.InstanceUser == "" {
+		fmt.Fprintf(os.Stderr, "No instance user given and none mapped for %s or profile %s or set as default in %s/config.yaml\n", cfg.InstanceName, profileLabel(&cfg), cfg.ConfigDir)
+		os.Exit(1)
+	}
+	cfg.KeyFiles = defaultKeyFiles
+	if len(fileConfig.KeyFiles) > 0 {
+		cfg.KeyFiles = fileConfig.KeyFiles
+	}
+	if len(cfg.PushKeys) == 0 {
+		cfg.PushKeys = fileConfig.PushKeys
+	}
+	if cfg.Keepalive == 0 {
+		cfg.Keepalive = fileConfig.Keepalive
+	}
+	if cfg.MaxDuration == 0 {
+		cfg.MaxDuration = fileConfig.MaxDuration
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = fileConfig.IdleTimeout
+	}
+	// traffic through a tunnel's local port isn't seen, a live tunnel would look idle
+	if cfg.IdleTimeout > 0 && command == "forward" {
+		if flagGiven("idle-timeout") {
+			fmt.Fprintln(os.Stderr, "--idle-timeout doesn't apply to port forwards (forward, db, rdp, kube), their traffic isn't seen")
+			os.Exit(1)
+		}
+		cfg.IdleTimeout = 0
+	}
+	if !cfg.Banner {
+		cfg.Banner = fileConfig.Banner
+	}
+	if !cfg.EncryptCache {
+		cfg.EncryptCache = fileConfig.EncryptCache
+	}
+	if !cfg.AllRegions {
+		cfg.AllRegions = fileConfig.AllRegions
+	}
+	if cfg.SharedCache == "" {
+		cfg.SharedCache = cmp.Or(fileConfig.Profiles[profileLabel(&cfg)].SharedCache, fileConfig.SharedCache)
+	}
+	if cfg.SharedCache != "" {
+		if _, err := parseSharedCache(cfg.SharedCache, cfg.S3Endpoint); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Resolver == "" {
+		cfg.Resolver = cmp.Or(fileConfig.Profiles[profileLabel(&cfg)].Resolver, fileConfig.Resolver, resolverEC2)
+	}
+	if err := validateResolver(cfg.Resolver); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the inventory has no stopped instances, and starting one takes ec2:StartInstances anyway
+	if cfg.StartStopped && cfg.Resolver == resolverSSM {
+		fmt.Fprintf(os.Stderr, "--start needs the %s resolver, the %s resolver only finds instances whose agent is registered\n", resolverEC2, resolverSSM)
+		os.Exit(1)
+	}
+	if cfg.Document == "" {
+		cfg.Document = fileConfig.Document
+		if len(cfg.Parameters) == 0 {
+			cfg.Parameters = fileConfig.Parameters
+		}
+	}
+
 	// create logger
 	opts := &slog.HandlerOptions{
 		Level: slog.LevelError,
 	}
+	if cfg.LogLevel != "" {
+		level, err := parseLogLevel(cfg.LogLevel)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.Level = level
+	}
 	if os.Getenv("SSM_SSH_CONNECT_DEBUG") == "1" {
 		opts.Level = slog.LevelDebug
 	}
 	logger := slog.New(slog.NewTextHandler(logFile, opts)).With("pid", os.Getpid())
 	slog.SetDefault(logger)
 
+	if err := setupProxy(cfg.Proxy); err != nil {
+		slog.Error("invalid proxy", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// the release is downloaded through the proxy
+	if command == "self-update" {
+		v, _, _ := buildInfo()
+		if err := selfUpdate(os.Stdout, v); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == "daemon" {
+		if err := runDaemon(); err != nil {
+			slog.Error("daemon failed", "error", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// Handle graceful shutdown
+	signals := make(chan os.Signal, 4)
+	go shutdown(signals, logFile)
+	signal.Notify(signals, resizeSignals...)
+	if db {
+		// Ctrl-C belongs to the database client, e.g. psql cancels the running query
+		signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+		signal.Notify(signals, terminationSignals...)
+	} else {
+		signal.Notify(signals, append([]os.Signal{os.Interrupt}, terminationSignals...)...)
+	}
+
+	// the deadline covers the whole way to the session, credential prompts and --start waits included
+	if cfg.InstanceName != "" && command != "resolve" {
+		startConnectDeadline(cfg.ConnectTimeout, cfg.InstanceName)
+	}
+	// a running daemon has the credentials and the instance at hand
+	if daemonEligible(command, fileConfig.ConfirmTags) {
+		if ok, err := runViaDaemon(); ok {
+			if err != nil {
+				slog.Error("Failed to start SSM session through the daemon", "error", err)
+				if !errors.Is(err, errSessionStopped) {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				os.Exit(exitCode(err))
+			}
+			return
+		}
+	}
+
 	// load AWS configuration
-	awsConfig, err = config.LoadDefaultConfig(context.TODO(), config.WithSharedConfigProfile(cfg.AwsProfile))
+	err = loadAWSConfig()
 	if err != nil {
-		slog.Error("unable to load AWS config")
+		slog.Error("unable to load AWS config", "error", err)
+		fmt.Fprintf(os.Stderr, "Unable to load AWS config: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Handle graceful shutdown
-	signal.Notify(shutdown(logFile), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if err := ensureCredentials(); err != nil {
+		slog.Error("AWS credentials are not usable", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if command == "sessions" {
+		if flag.Arg(0) == "terminate" {
+			err = terminateSessions(os.Stdout, sessionIDs)
+		} else {
+			var rows []sessionRow
+			rows, err = activeSessions()
+			if err == nil {
+				err = writeSessions(os.Stdout, rows, cfg.Output, time.Now())
+			}
+		}
+		if err != nil {
+			slog.Error("Failed to manage sessions", "error", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == "list" {
+		if err := listInstances(os.Stdout, cfg.Output); err != nil {
+			slog.Error("Failed to list instances", "error", err)
+			fmt.Fprintf(os.Stderr, "Failed to list instances: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == "cache" {
+		err := warmCache(os.Stdout, func(name string) string {
+			if user := flag.Arg(2); user != "" && user != "-" {
+				return user
+			}
+			return fileConfig.user(name, profileLabel(&cfg))
+		})
+		if err != nil {
+			slog.Error("Failed to warm the cache", "error", err)
+			fmt.Fprintf(os.Stderr, "Failed to warm the cache: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if command == "ssh-config" {
+		executable, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to find own executable: %v\n", err)
+			os.Exit(1)
+		}
+		rows, err := runningInstances()
+		if err != nil {
+			slog.Error("Failed to list instances", "error", err)
+			fmt.Fprintf(os.Stderr, "Failed to list instances: %v\n", err)
+			os.Exit(1)
+		}
+		writeSSHConfig(os.Stdout, rows, cfg.Tags, executable, cfg.AwsProfile, func(name string) string {
+			return fileConfig.user(name, profileLabel(&cfg))
+		})
+		return
+	}
+	if command == "tui" {
+		instanceID, err := browseInstances(os.Stdin, os.Stdout)
+		if err != nil {
+			slog.Error("Failed to browse instances", "error", err)
+			fmt.Fprintf(os.Stderr, "Failed to browse instances: %v\n", err)
+			os.Exit(1)
+		}
+		if instanceID == "" {
+			return
+		}
+		// the chosen instance gets a shell, as with the shell command
+		cfg.InstanceName = instanceID
+		cfg.Shell = true
+		command = "shell"
+		startConnectDeadline(cfg.ConnectTimeout, cfg.InstanceName)
+	}
+
+	// ECS Exec sessions run in a container, there is no instance to look up or log in to
+	if strings.HasPrefix(cfg.InstanceName, ecsExecPrefix) {
+		if !cfg.Shell && command != "run" {
+			fmt.Fprintln(os.Stderr, "ECS Exec targets support only shell and run")
+			os.Exit(1)
+		}
+		if cfg.DryRun {
+			fmt.Fprintf(os.Stderr, "Would run ECS Exec in %s: %s\n", cfg.InstanceName, cmp.Or(cfg.Command, ecsExecShell))
+			return
+		}
+		if err := runECSExec(cfg.InstanceName, cfg.Command); err != nil {
+			slog.Error("ECS Exec session failed", "error", err)
+			if !errors.Is(err, errSessionStopped) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	// per-target cache files of earlier versions
+	if err := importCacheFiles(cfg.CacheDir); err != nil {
+		slog.Warn("failed to import cache files", "error", err)
+	}
+
+	// keep the cache and the logs from growing over the months
+	if now := time.Now(); pruneDue(cfg.StateDir, now) {
+		maxAge, maxStorageMB := defaultPruneAfter, defaultMaxStorageMB
+		if fileConfig.PruneAfter != nil {
+			maxAge = *fileConfig.PruneAfter
+		}
+		if fileConfig.MaxStorageMB != nil {
+			maxStorageMB = *fileConfig.MaxStorageMB
+		}
+		if err := prune(cfg.CacheDir, cfg.StateDir, maxAge, int64(maxStorageMB)*1024*1024, now); err != nil {
+			slog.Warn("failed to prune", "error", err)
+		}
+	}
+
+	// try to load cache, --no-cache still refreshes it with the fresh lookup
+	useCache := cacheable(cfg.InstanceName) && cfg.CacheTTL > 0
+	if useCache && !cfg.NoCache {
+		if err := loadCache(&cfg); errors.Is(err, errInstanceNotFound) {
+			slog.Error("Failed to get instance details", "error", err)
+			os.Exit(1)
+		}
+		if cfg.InstanceID == "" && cfg.SharedCache != "" {
+			if err := loadSharedCache(&cfg); err != nil {
+				slog.Info("instance details not found in the shared cache", "error", err)
+			}
+		}
+		slog.Info("loaded cache: ", "cfg", cfg)
+		cfg.FromCache = cfg.InstanceID != ""
+	}
 
-	// try to load cache
-	loadCache(&cfg)
-	slog.Info("loaded cache: ", "cfg", cfg)
+	// concurrent invocations for the target wait for the first one's lookup and load it from the cache
+	unlockResolve := func() {}
+	if cfg.InstanceID == "" && useCache && !cfg.NoCache {
+		lockPath := resolveLockPath(&cfg)
+		unlock, err := lock(lockPath)
+		if err != nil {
+			slog.Warn("failed to lock the lookup", "error", err)
+		} else {
+			unlockResolve = unlock
+			now := time.Now()
+			os.Chtimes(lockPath, now, now)
+			if err := loadCache(&cfg); errors.Is(err, errInstanceNotFound) {
+				slog.Error("Failed to get instance details", "error", err)
+				os.Exit(1)
+			}
+			cfg.FromCache = cfg.InstanceID != ""
+		}
+	}
 
 	// get instance details
 	if cfg.InstanceID == "" {
@@ -91,183 +815,641 @@ func main() {
 		// Get the instance ID and region by name
 		err = getInstanceDetails()
 		if err != nil {
+			if useCache && errors.Is(err, errInstanceNotFound) {
+				if err := saveNotFound(&cfg); err != nil {
+					slog.Warn("failed to save cache", "error", err)
+				}
+			}
 			slog.Error("Failed to get instance details", "error", err)
 			os.Exit(1)
 		}
 
-		slog.Info("saving instance details to cache")
-		saveCache(&cfg)
+		if useCache {
+			slog.Info("saving instance details to cache")
+			if err := saveCache(&cfg); err != nil {
+				slog.Warn("failed to save cache", "error", err)
+			}
+		}
+	}
+	unlockResolve()
+
+	// the instance may live outside of the profile's default region
+	awsConfig.Region = cfg.Region
+
+	if command == "resolve" {
+		if err := writeResolution(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write resolution: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.StartStopped && !cfg.Hybrid && !cfg.DryRun {
+		if err := ensureInstanceRunning(); err != nil {
+			slog.Error("Failed to start instance", "error", err)
+			fmt.Fprintf(os.Stderr, "Failed to start instance: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// fail fast if the SSM agent can't take the session
+	err = checkSSMOnline()
+	var apiErr smithy.APIError
+	if err != nil && !errors.As(err, &apiErr) && refreshCachedInstance(err) {
+		err = checkSSMOnline()
+	}
+	if err != nil {
+		if errors.As(err, &apiErr) {
+			// e.g. no permission to describe instance information, let StartSession decide
+			slog.Warn("unable to check SSM agent status", "error", err)
+		} else {
+			slog.Error("SSM agent is not available", "error", err)
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if kube {
+		host, err := eksEndpointHost(cfg.KubeCluster)
+		if err != nil {
+			slog.Error("failed to look up EKS endpoint", "error", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg.Forwards[0].Host = host
+	}
+
+	if cfg.DryRun {
+		// stdout may be the ssh stream
+		if err := dryRun(os.Stderr, command, passArgs, db); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := confirmSession(fileConfig.ConfirmTags); err != nil {
+		slog.Error("session not confirmed", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if cfg.Banner {
+		if err := showBanner(); err != nil {
+			slog.Warn("failed to show banner", "error", err)
+		}
+	}
+
+	if command == "run" {
+		exitCode, err := runCommand(cfg.Command, os.Stdout, os.Stderr)
+		if err != nil {
+			slog.Error("failed to run command", "error", err)
+			fmt.Fprintf(os.Stderr, "Failed to run command: %v\n", err)
+		}
+		os.Exit(exitCode)
+	}
+
+	// ssh, scp and sftp run this tool again as their ProxyCommand, which pushes the key
+	forwardsOut := io.Writer(os.Stdout)
+	if db {
+		// stdout belongs to the database client
+		forwardsOut = io.Discard
+	}
+	if err := cfg.Forwards.assignFreePorts(forwardsOut, os.Stderr); err != nil {
+		slog.Error("failed to assign local port", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if program, args := wrappedCommand(command, passArgs); program != "" {
+		// ssh starts the session itself, through this tool as its ProxyCommand
+		connected()
+		runSSH(program, args...)
+	}
+	if command == "forward" {
+		keepForwardAlive(cfg.Forwards[0].LocalPort, cfg.Keepalive)
+		if kube {
+			fmt.Fprintln(os.Stderr, kubeHint(cfg.Forwards[0].LocalPort, cfg.Forwards[0].Host))
+		}
+		if db {
+			os.Exit(runDBClient(cfg.Forwards[0].LocalPort, passArgs))
+		}
+		if rdp && cfg.LaunchRDP {
+			go launchRDPClient(cfg.Forwards[0].LocalPort)
+		}
+	}
+
+	// a cached instance that is gone is looked up again, once; the instance found instead is
+	// confirmed like the first one was
+	refresh := func(err error) bool {
+		if !staleInstance(err) || !refreshCachedInstance(err) {
+			return false
+		}
+		if err := confirmSession(fileConfig.ConfirmTags); err != nil {
+			slog.Error("session not confirmed", "error", err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return true
 	}
 
 	// send SSH public key if needed
-	lockFileName := fmt.Sprintf(
-		"%s/%s-%s-%s.lock",
-		cfg.AppHome,
-		cfg.AwsProfile,
-		cfg.InstanceName,
-		cfg.InstanceUser,
-	)
-
-	slog.Info("checking lock file " + lockFileName)
-
-	// remove lock file if its older than 50 seconds
-	s, err = os.Stat(lockFileName)
-	if err == nil && time.Since(s.ModTime()) > 50*time.Second {
-		os.Remove(lockFileName)
-	}
-
-	if lockFile, err := os.OpenFile(lockFileName, os.O_EXCL|os.O_CREATE, 0660); err == nil {
-		// remove lock file on exit
-		defer func() {
-			lockFile.Close()
-			os.Remove(lockFileName)
-		}()
-
-		// or remove it after 50 seconds, since public key is valid for 60 seconds only
-		go func() {
-			time.Sleep(50 * time.Second)
-			lockFile.Close()
-			os.Remove(lockFileName)
-		}()
-
-		// send SSH public key
-		slog.Info("sending SSH public key")
-		if err := sendSSHPublicKey(); err != nil {
+	if reason := keyPushSkipReason(command); reason != "" {
+		slog.Info(reason + ", skipping SSH public key push")
+	} else if err := sendSSHPublicKey(); err != nil {
+		if refresh(err) {
+			err = sendSSHPublicKey()
+		}
+		if err != nil {
 			slog.Error("failed to send SSH public key", "error", err)
+			fmt.Fprintf(os.Stderr, "Failed to send SSH public key: %v\n", err)
 		}
-		slog.Info("SSH public key sent")
 	}
 
 	// Start SSM session
 	slog.Info("starting SSM session")
-	err = startSSMSessionWithPlugin()
-	if err != nil {
+	start := func() error {
+		return runSession(cfg.Reconnect && (command == "forward" || cfg.Shell), command == "forward")
+	}
+	err = start()
+	if refresh(err) {
+		// the key went to the stale instance
+		if keyPushSkipReason(command) == "" {
+			if err := sendSSHPublicKey(); err != nil {
+				slog.Error("failed to send SSH public key", "error", err)
+				fmt.Fprintf(os.Stderr, "Failed to send SSH public key: %v\n", err)
+			}
+		}
+		err = start()
+	}
+	if errors.Is(err, errNoSSHServer) {
+		err = offerShell(err)
+	}
+	if errors.Is(err, errSessionStopped) {
+		slog.Info("session stopped by signal")
+	} else if err != nil {
 		slog.Error("Failed to start SSM session", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+	}
+	slog.Info("session completed", "exit_code", exitCode(err))
+	if err != nil {
+		logFile.Close()
+		os.Exit(exitCode(err))
+	}
+}
+
+// keyPushSkipReason tells why no SSH public key is pushed for the command, or returns "" when one is
+func keyPushSkipReason(command string) string {
+	switch {
+	case command == "forward" || cfg.Shell:
+		return "no ssh login"
+	case cfg.Hybrid:
+		// EC2 Instance Connect only works for EC2 instances, the key must already be authorized
+		return "managed instance has no EC2 record"
+	case cfg.Platform == platformWindows:
+		// EC2 Instance Connect does not support Windows instances
+		return "Windows instance"
+	}
+	return ""
+}
+
+// cacheable reports whether the resolved instance may be cached for the target,
+// globs, Auto Scaling groups, ECS services and EKS node selectors match fleets that are replaced on every deploy
+// or scale event, so they are always resolved fresh
+func cacheable(name string) bool {
+	switch {
+	case strings.ContainsAny(name, "*?"), strings.HasPrefix(name, "asg:"), strings.HasPrefix(name, "ecs:"):
+		return false
+	case strings.HasPrefix(name, "eks:"):
+		// only a specific node name is stable
+		_, node, _ := strings.Cut(name, "/")
+		return node != "" && !strings.Contains(node, "=")
+	}
+	return true
+}
+
+// fileSafeName escapes the instance name for use in cache and lock file names,
+// since targets like ecs:<cluster>/<service> contain path separators
+func fileSafeName(name string) string {
+	return url.PathEscape(name)
+}
+
+// profileLabel names the credential source in cache and lock file names
+func profileLabel(cfg *Config) string {
+	if cfg.AwsProfile != "" {
+		return cfg.AwsProfile
+	}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+// defaultCacheTTL is how long a resolved instance is cached unless the config file says otherwise
+const defaultCacheTTL = 24 * time.Hour
+
+// notFoundCacheTTL is how long a target that was not found is remembered, so ssh retries and channels
+// don't repeat the lookup, while a freshly launched instance is still found soon
+const notFoundCacheTTL = 15 * time.Second
+
+var errInstanceNotFound = errors.New("instance not found or not in running state")
+
+// selectorSuffix distinguishes cache entries of the same target resolved with different selection options
+// or in a different account or region
+func selectorSuffix(cfg *Config) string {
+	selectors := strings.Join([]string{cfg.Excludes.String(), cfg.VpcID, cfg.SubnetID, cfg.PlatformOnly, cfg.RoleARN, cfg.RegionFlag}, "|")
+	if strings.Trim(selectors, "|") == "" {
+		return ""
 	}
-	slog.Info("session completed")
+	sum := sha256.Sum256([]byte(selectors))
+	return "-" + hex.EncodeToString(sum[:4])
 }
 
 func saveCache(cfg *Config) error {
-	cacheFile := fmt.Sprintf(
-		"%s/%s-%s-%s.json",
-		cfg.AppHome,
-		cfg.AwsProfile,
-		cfg.InstanceName,
-		cfg.InstanceUser,
-	)
+	cfg.CachedName = cfg.InstanceName
 
 	data, err := json.Marshal(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %v", err)
 	}
 
-	if err := os.WriteFile(cacheFile, data, 0660); err != nil {
-		return fmt.Errorf("failed to write cache file: %v", err)
+	entry := cacheEntry{Saved: time.Now(), Profile: profileLabel(cfg), Instance: data}
+	if err := updateCacheDB(cfg.CacheDir, func(db *cacheDB) {
+		db.Entries[cacheEntryKey(cfg)] = entry
+	}); err != nil {
+		return fmt.Errorf("failed to write cache: %v", err)
+	}
+
+	if cfg.SharedCache != "" {
+		if err := saveSharedCache(cfg, entry); err != nil {
+			slog.Warn("failed to save to the shared cache", "error", err)
+		}
 	}
+	return nil
+}
 
+// saveNotFound remembers that the target was not found
+func saveNotFound(cfg *Config) error {
+	if err := updateCacheDB(cfg.CacheDir, func(db *cacheDB) {
+		db.Entries[cacheEntryKey(cfg)] = cacheEntry{Saved: time.Now(), Profile: profileLabel(cfg), NotFound: true}
+	}); err != nil {
+		return fmt.Errorf("failed to write cache: %v", err)
+	}
 	return nil
 }
 
 func loadCache(cfg *Config) error {
-	cacheFile := fmt.Sprintf(
-		"%s/%s-%s-%s.json",
-		cfg.AppHome,
-		cfg.AwsProfile,
-		cfg.InstanceName,
-		cfg.InstanceUser,
-	)
+	db, err := readCacheDB(cfg.CacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache: %v", err)
+	}
 
 	// check if cache exists
-	info, err := os.Stat(cacheFile)
-	if err != nil {
+	entry, ok := db.Entries[cacheEntryKey(cfg)]
+	if !ok {
 		return fmt.Errorf("cache does not exist")
 	}
 
 	// ttl
-	if time.Since(info.ModTime()) > 24*time.Hour {
+	if entry.NotFound {
+		if age := time.Since(entry.Saved); age <= min(notFoundCacheTTL, cfg.CacheTTL) {
+			return fmt.Errorf("%w (looked up %v ago)", errInstanceNotFound, age.Truncate(time.Second))
+		}
 		return fmt.Errorf("cache is expired")
 	}
-
-	// read cache
-	data, err := os.ReadFile(cacheFile)
-	if err != nil {
-		return fmt.Errorf("failed to read cache file: %v", err)
+	if time.Since(entry.Saved) > cfg.CacheTTL {
+		return fmt.Errorf("cache is expired")
 	}
 
 	// parse cache
-	if err := json.Unmarshal(data, cfg); err != nil {
+	if err := json.Unmarshal(entry.Instance, cfg); err != nil {
 		return fmt.Errorf("failed to unmarshal config: %v", err)
 	}
 
 	return nil // cache is valid and loaded
 }
 
-func shutdown(logFile *os.File) chan os.Signal {
-	signals := make(chan os.Signal, 1)
-	go func() {
-		s := <-signals
-		for s == syscall.SIGHUP {
+// shutdown handles the signals of a session: window size changes are relayed to the session's process, and
+// termination signals stop it, so the plugin isn't orphaned and the session ends through the usual cleanup.
+// Without a running process there is nothing to clean up after, and the process exits.
+func shutdown(signals <-chan os.Signal, logFile *os.File) {
+	for s := range signals {
+		switch {
+		case s == syscall.SIGHUP:
 			slog.Info("received SIGHUP signal: ignoring")
-			s = <-signals
+		case slices.Contains(resizeSignals, s):
+			relaySignal(s, false)
+		case relaySignal(s, true):
+			slog.Warn("received shutdown signal: stopping the session", "signal", s.String())
+		default:
+			slog.Warn("received shutdown signal: exiting" + s.String())
+			logFile.Close()
+			os.Exit(signalExitCode(s))
 		}
-		slog.Warn("received shutdown signal: exiting" + s.String())
-		logFile.Close()
-		os.Exit(0)
-	}()
-
-	return signals
+	}
 }
 
 func getInstanceDetails() error {
-	client := ec2.NewFromConfig(awsConfig)
-	result, err := client.DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+	// name#N selects the Nth instance (by launch time) among all matches
+	target, index := splitIndex(cfg.InstanceName)
+
+	if managedInstanceIDPattern.MatchString(target) {
+		return getManagedInstanceDetails()
+	}
+	if cfg.Resolver == resolverSSM {
+		return getSSMInstanceDetails(target, index)
+	}
+
+	client := ec2Client()
+	input := &ec2.DescribeInstancesInput{
 		Filters: []ec2Types.Filter{
-			{
-				Name:   aws.String("tag:Name"),
-				Values: []string{cfg.InstanceName},
-			},
 			{
 				Name:   aws.String("instance-state-name"),
 				Values: []string{"running"},
 			},
 		},
-	})
+	}
+	if cfg.StartStopped {
+		input.Filters[0].Values = startableStates
+	}
+	if cfg.VpcID != "" {
+		input.Filters = append(input.Filters, ec2Types.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []string{cfg.VpcID},
+		})
+	}
+	if cfg.SubnetID != "" {
+		input.Filters = append(input.Filters, ec2Types.Filter{
+			Name:   aws.String("subnet-id"),
+			Values: []string{cfg.SubnetID},
+		})
+	}
+
+	switch {
+	case strings.HasPrefix(target, "asg:"):
+		ids, err := getAutoScalingGroupInstanceIDs(strings.TrimPrefix(target, "asg:"))
+		if err != nil {
+			return err
+		}
+		input.InstanceIds = ids
+	case strings.HasPrefix(target, "ecs:"):
+		ids, err := getECSServiceInstanceIDs(strings.TrimPrefix(target, "ecs:"))
+		if err != nil {
+			return err
+		}
+		input.InstanceIds = ids
+	case strings.HasPrefix(target, "cfn:"):
+		ids, err := getStackInstanceIDs(strings.TrimPrefix(target, "cfn:"))
+		if err != nil {
+			return err
+		}
+		input.InstanceIds = ids
+	case strings.HasPrefix(target, "eks:"):
+		filters, err := eksFilters(strings.TrimPrefix(target, "eks:"))
+		if err != nil {
+			return err
+		}
+		input.Filters = append(input.Filters, filters...)
+	case instanceIDPattern.MatchString(target):
+		// instance ID is given directly, so we only need its AZ/region
+		input.InstanceIds = []string{target}
+	case net.ParseIP(target) != nil:
+		input.Filters = append(input.Filters, ec2Types.Filter{
+			Name:   aws.String(ipAddressFilter(target)),
+			Values: []string{target},
+		})
+	case privateDNSPattern.MatchString(target):
+		input.Filters = append(input.Filters, ec2Types.Filter{
+			Name:   aws.String("private-dns-name"),
+			Values: []string{target},
+		})
+	default:
+		input.Filters = append(input.Filters, ec2Types.Filter{
+			Name:   aws.String("tag:Name"),
+			Values: []string{target},
+		})
+	}
+
+	instances, err := describeInstances(client, input)
+	if instanceIDNotFound(err) {
+		// an instance ID of another region is an error rather than no match
+		instances, err = nil, nil
+	}
 	if err != nil {
 		return err
 	}
+	if len(instances) == 0 && cfg.AllRegions {
+		slog.Info("instance not found in the default region, searching all enabled regions")
+		instances, err = describeInstancesInAllRegions(input)
+		if err != nil {
+			return err
+		}
+	}
+	instances = excludeInstances(instances, cfg.Excludes)
+	instances = filterPlatform(instances, cfg.PlatformOnly)
+	if len(instances) == 0 {
+		return errInstanceNotFound
+	}
+	if cfg.StartStopped {
+		instances = preferRunning(instances)
+	}
+	rankInstances(instances)
 
-	for _, reservation := range result.Reservations {
-		for _, instance := range reservation.Instances {
-			cfg.InstanceID = *instance.InstanceId
-			cfg.InstanceAZ = *instance.Placement.AvailabilityZone
-			cfg.Region = cfg.InstanceAZ[:len(cfg.InstanceAZ)-1]
-			return nil
+	instance := instances[0]
+	switch {
+	case index > 0:
+		sortByLaunchTime(instances)
+		if index > len(instances) {
+			return fmt.Errorf("instance #%d requested, but only %d instances match %q", index, len(instances), target)
+		}
+		instance = instances[index-1]
+	case strings.HasPrefix(target, "asg:"):
+		instance = pickAutoScalingGroupInstance(instances)
+	case strings.ContainsAny(target, "*?"):
+		// name is a glob (e.g. autoscaled fleet), so prefer the most recently launched instance
+		instance = newestInstance(instances)
+		if len(instances) > 1 {
+			slog.Info("multiple instances match, using the newest one", "count", len(instances), "instance_id", *instance.InstanceId)
+		}
+	case len(instances) > 1:
+		// target is ambiguous, let the user choose
+		instance, err = pickInstance(instances)
+		if errors.Is(err, errNoTTY) {
+			slog.Warn("multiple instances match and there is no terminal to choose from, using the newest one", "count", len(instances))
+			instance = instances[0]
+		} else if err != nil {
+			return err
 		}
 	}
-	return fmt.Errorf("instance not found or not in running state")
+
+	cfg.InstanceID = *instance.InstanceId
+	cfg.InstanceAZ = *instance.Placement.AvailabilityZone
+	cfg.Platform = platformOf(instance)
+	cfg.Region = cfg.InstanceAZ[:len(cfg.InstanceAZ)-1]
+	return nil
 }
 
-func sendSSHPublicKey() error {
-	// send SSH public key
-	client := ec2instanceconnect.NewFromConfig(awsConfig)
+func describeInstances(client *ec2.Client, input *ec2.DescribeInstancesInput) ([]ec2Types.Instance, error) {
+	// a wildcard or tag filter may match more reservations than one page holds
+	var instances []ec2Types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(client, input)
+	for paginator.HasMorePages() {
+		ctx, cancel := apiContext()
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	return instances, nil
+}
 
-	publicKeyPath := fmt.Sprintf("%s/.ssh/id_rsa.pub", os.Getenv("HOME"))
-	publicKey, err := os.ReadFile(publicKeyPath)
+// ipAddressFilter returns the DescribeInstances filter name for the given IP address,
+// private-ip-address only matches IPv4, so IPv6 addresses are looked up on network interfaces
+func ipAddressFilter(ip string) string {
+	if net.ParseIP(ip).To4() != nil {
+		return "private-ip-address"
+	}
+	return "network-interface.ipv6-addresses.ipv6-address"
+}
+
+func pickInstance(instances []ec2Types.Instance) (ec2Types.Instance, error) {
+	items := make([]string, len(instances))
+	for i, instance := range instances {
+		items[i] = fmt.Sprintf(
+			"%-20s %-12s %-20s %s",
+			aws.ToString(instance.InstanceId),
+			aws.ToString(instance.Placement.AvailabilityZone),
+			aws.ToTime(instance.LaunchTime).Local().Format(time.DateTime),
+			aws.ToString(instance.PrivateIpAddress),
+		)
+	}
+
+	i, err := pick(fmt.Sprintf("multiple running instances match %q:", cfg.InstanceName), items)
 	if err != nil {
-		return fmt.Errorf("failed to read SSH public key: %v", err)
+		return ec2Types.Instance{}, err
+	}
+	return instances[i], nil
+}
+
+// splitIndex splits a name#N target into the name and the 1-based index, index is 0 if not given
+func splitIndex(name string) (string, int) {
+	i := strings.LastIndex(name, "#")
+	if i < 0 {
+		return name, 0
+	}
+	index, err := strconv.Atoi(name[i+1:])
+	if err != nil || index < 1 {
+		return name, 0
 	}
+	return name[:i], index
+}
 
-	_, err = client.SendSSHPublicKey(context.TODO(), &ec2instanceconnect.SendSSHPublicKeyInput{
-		InstanceId:       aws.String(cfg.InstanceID),
-		InstanceOSUser:   aws.String(cfg.InstanceUser),
-		SSHPublicKey:     aws.String(string(publicKey)),
-		AvailabilityZone: aws.String(cfg.InstanceAZ),
+func sortByLaunchTime(instances []ec2Types.Instance) {
+	sort.SliceStable(instances, func(i, j int) bool {
+		return aws.ToTime(instances[i].LaunchTime).Before(aws.ToTime(instances[j].LaunchTime))
 	})
+}
+
+// rankInstances orders the matches newest first, with the instance ID breaking ties, so the choice doesn't depend
+// on how the matches are spread over reservations and pages
+func rankInstances(instances []ec2Types.Instance) {
+	sort.SliceStable(instances, func(i, j int) bool {
+		ti, tj := aws.ToTime(instances[i].LaunchTime), aws.ToTime(instances[j].LaunchTime)
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return aws.ToString(instances[i].InstanceId) < aws.ToString(instances[j].InstanceId)
+	})
+}
+
+func newestInstance(instances []ec2Types.Instance) ec2Types.Instance {
+	newest := instances[0]
+	for _, instance := range instances[1:] {
+		if aws.ToTime(instance.LaunchTime).After(aws.ToTime(newest.LaunchTime)) {
+			newest = instance
+		}
+	}
+	return newest
+}
+
+func sendSSHPublicKey() error {
+	publicKeys, err := readPublicKeys()
 	if err != nil {
-		return fmt.Errorf("failed to send SSH public key: %v", err)
+		return err
 	}
+	return sendPublicKeys(publicKeys)
+}
 
-	return nil
+// sendPublicKeys pushes the public keys to the instance unless they are still authorized
+func sendPublicKeys(publicKeys [][]byte) error {
+	// concurrent invocations (e.g. ssh multiplexing several channels) wait for each other on the
+	// instance's push lock, so a key is pushed only once per validity period. The cache database is
+	// only locked to record the pushes, other connections don't wait for them.
+	lockPath := pushLockPath(&cfg)
+	unlock, err := lock(lockPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	now := time.Now()
+	os.Chtimes(lockPath, now, now)
+
+	db, err := readCacheDB(cfg.CacheDir)
+	if err != nil {
+		slog.Warn("failed to read the pushed keys", "error", err)
+	}
+	pushed, pushErr := pushKeys(ec2InstanceConnectClient(), publicKeys, db.PushedKeys, now)
+	if len(pushed) > 0 {
+		err = updateCacheDB(cfg.CacheDir, func(db *cacheDB) {
+			db.PushedKeys.prune(time.Now())
+			for _, id := range pushed {
+				db.PushedKeys[id] = now
+			}
+		})
+	}
+	if pushErr != nil {
+		return pushErr
+	}
+	return err
+}
+
+// pushKeys pushes the keys that are due and returns the IDs of those it pushed
+func pushKeys(client *ec2instanceconnect.Client, publicKeys [][]byte, pushed pushedKeys, now time.Time) ([]string, error) {
+	var sent []string
+	for _, publicKey := range publicKeys {
+		id, err := pushedKeyID(cfg.InstanceID, cfg.InstanceUser, publicKey)
+		if err != nil {
+			return sent, err
+		}
+		if !pushed.due(id, now) {
+			slog.Info("SSH public key is still authorized, skipping push", "key", id, "pushed", pushed[id])
+			continue
+		}
+
+		slog.Info("sending SSH public key", "key", id)
+		input := &ec2instanceconnect.SendSSHPublicKeyInput{
+			InstanceId:     aws.String(cfg.InstanceID),
+			InstanceOSUser: aws.String(cfg.InstanceUser),
+			SSHPublicKey:   aws.String(string(publicKey)),
+		}
+		// the ssm resolver finds no AZ, which EC2 Instance Connect doesn't need
+		if cfg.InstanceAZ != "" {
+			input.AvailabilityZone = aws.String(cfg.InstanceAZ)
+		}
+		ctx, cancel := apiContext()
+		_, err = client.SendSSHPublicKey(ctx, input)
+		cancel()
+		if err != nil {
+			return sent, fmt.Errorf("failed to send SSH public key: %w", err)
+		}
+		// the key's validity starts no later than the request was made
+		sent = append(sent, id)
+	}
+	return sent, nil
 }
 
 type StartSessionRequestData struct {
@@ -282,70 +1464,64 @@ type StartSessionResponseData struct {
 	TokenValue string `json:"TokenValue"`
 }
 
-func startSSMSessionWithPlugin() error {
-	ssmClient := ssm.NewFromConfig(awsConfig)
-
-	// Use the custom struct for the request
-	startSessionRequestData := StartSessionRequestData{
-		Target:       cfg.InstanceID,
-		DocumentName: "AWS-StartSSHSession",
-		Parameters:   map[string][]string{"portNumber": {"22"}},
+// findPlugin returns the path of the session-manager-plugin binary: --plugin-path, which may also name
+// a command on the PATH, or else the first found on the PATH or in the installers' paths
+func findPlugin() (string, error) {
+	if cfg.PluginPath != "" {
+		path, err := exec.LookPath(cfg.PluginPath)
+		if err != nil {
+			return "", fmt.Errorf("session-manager-plugin not found at %s: %v", cfg.PluginPath, err)
+		}
+		return path, nil
 	}
-
-	// Create the StartSessionInput for the API call
-	startSessionInput := &ssm.StartSessionInput{
-		Target:       aws.String(startSessionRequestData.Target),
-		DocumentName: aws.String(startSessionRequestData.DocumentName),
-		Parameters:   startSessionRequestData.Parameters,
+	if path, err := exec.LookPath("session-manager-plugin"); err == nil {
+		return path, nil
 	}
-
-	// Call the StartSession API
-	startSessionOutput, err := ssmClient.StartSession(context.TODO(), startSessionInput)
-	if err != nil {
-		return fmt.Errorf("failed to start SSM session: %v", err)
+	for _, path := range pluginPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
 	}
+	return "", fmt.Errorf("session-manager-plugin binary not found on the PATH or in %s, use --plugin-path", strings.Join(pluginPaths, ", "))
+}
 
-	// Use the custom struct for the response
-	startSessionResponseData := StartSessionResponseData{
-		SessionID:  aws.ToString(startSessionOutput.SessionId),
-		StreamURL:  aws.ToString(startSessionOutput.StreamUrl),
-		TokenValue: aws.ToString(startSessionOutput.TokenValue),
+// sessionRequest returns the StartSession request for the target
+func sessionRequest() StartSessionRequestData {
+	documentName, parameters := sessionDocument()
+	return StartSessionRequestData{
+		Target:       cfg.InstanceID,
+		DocumentName: documentName,
+		Parameters:   parameters,
 	}
+}
 
+// pluginArgs returns the session-manager-plugin command line that connects to the started session
+func pluginArgs(startSessionResponseData StartSessionResponseData, startSessionRequestData StartSessionRequestData) ([]string, error) {
 	// Marshal the custom structs to JSON
 	startSessionResponse, err := json.Marshal(startSessionResponseData)
 	if err != nil {
-		return fmt.Errorf("failed to marshal start session response: %v", err)
+		return nil, fmt.Errorf("failed to marshal start session response: %v", err)
 	}
 
 	startSessionRequest, err := json.Marshal(startSessionRequestData)
 	if err != nil {
-		return fmt.Errorf("failed to marshal start session request: %v", err)
+		return nil, fmt.Errorf("failed to marshal start session request: %v", err)
 	}
 
-	endpoint := fmt.Sprintf("https://ssm.%s.amazonaws.com", cfg.Region)
-
-	// find the session-manager-plugin binary using common paths
-	var pluginPath string
-	commonPaths := []string{
-		"session-manager-plugin",                   // $PATH
-		"/usr/local/bin/session-manager-plugin",    // default
-		"/usr/bin/session-manager-plugin",          // linux
-		"/opt/homebrew/bin/session-manager-plugin", // macos (homebrew)
-	}
-	for _, path := range commonPaths {
-		if _, err := os.Stat(path); err == nil {
-			pluginPath = path
-			break
-		}
+	endpoint, err := ssmEndpoint(cfg.Region, cfg.FIPS)
+	if err != nil {
+		return nil, err
 	}
-	if pluginPath == "" {
-		return fmt.Errorf("session-manager-plugin binary not found")
+
+	pluginPath, err := findPlugin()
+	if err != nil {
+		return nil, err
 	}
+	checkPluginVersion(pluginPath)
 
 	// Correct the argument order based on the ValidateInputAndStartSession function
 	// (see https://github.com/aws/session-manager-plugin/blob/mainline/src/sessionmanagerplugin/session/session.go)
-	cmd := exec.Command(
+	return []string{
 		pluginPath,
 		string(startSessionResponse), // args[1]: Session response
 		cfg.Region,                   // args[2]: Client region
@@ -353,15 +1529,122 @@ func startSSMSessionWithPlugin() error {
 		cfg.AwsProfile,               // args[4]: Profile name
 		string(startSessionRequest),  // args[5]: Parameters input to AWS CLI for StartSession API
 		endpoint,                     // args[6]: Endpoint for SSM service
-	)
+	}, nil
+}
+
+// pluginCommand starts the SSM session for the target and returns the session-manager-plugin command
+// that connects it to stdin and stdout
+func pluginCommand() (*exec.Cmd, string, error) {
+	ssmClient := ssmClient()
+
+	// Use the custom struct for the request
+	startSessionRequestData := sessionRequest()
 
+	// Create the StartSessionInput for the API call
+	startSessionInput := &ssm.StartSessionInput{
+		Target:       aws.String(startSessionRequestData.Target),
+		DocumentName: aws.String(startSessionRequestData.DocumentName),
+		Parameters:   startSessionRequestData.Parameters,
+	}
+	if cfg.Reason != "" {
+		startSessionInput.Reason = aws.String(cfg.Reason)
+	}
+
+	// Call the StartSession API
+	ctx, cancel := apiContext()
+	defer cancel()
+	startSessionOutput, err := ssmClient.StartSession(ctx, startSessionInput)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to start SSM session: %w", err)
+	}
+	connected()
+
+	// Use the custom struct for the response
+	startSessionResponseData := StartSessionResponseData{
+		SessionID:  aws.ToString(startSessionOutput.SessionId),
+		StreamURL:  aws.ToString(startSessionOutput.StreamUrl),
+		TokenValue: aws.ToString(startSessionOutput.TokenValue),
+	}
+	audit(auditEntry{
+		InstanceID: cfg.InstanceID,
+		Region:     cfg.Region,
+		User:       cfg.InstanceUser,
+		Document:   startSessionRequestData.DocumentName,
+		SessionID:  startSessionResponseData.SessionID,
+	})
+
+	args, err := pluginArgs(startSessionResponseData, startSessionRequestData)
+	if err != nil {
+		return nil, "", err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	return cmd, startSessionResponseData.SessionID, nil
+}
+
+func startSSMSessionWithPlugin() error {
+	return runPluginSession(os.Stdin, os.Stdout)
+}
+
+// runPluginSession starts the session and runs the session-manager-plugin on stdin and stdout
+func runPluginSession(stdin, stdout *os.File) error {
+	cmd, sessionID, err := pluginCommand()
+	if err != nil {
+		return err
+	}
+	cmd.Stdin, cmd.Stdout = stdin, stdout
+
+	watched := cfg.MaxDuration > 0 || cfg.IdleTimeout > 0 || dbClientDone != nil
+	traffic := &activity{}
+	if cfg.IdleTimeout > 0 {
+		cmd.Stdin = activityReader{r: stdin, activity: traffic}
+		cmd.Stdout = activityWriter{w: stdout, activity: traffic}
+		// don't wait for more input once the plugin is gone
+		cmd.WaitDelay = time.Second
+	}
+	if dbClientDone != nil {
+		// the database client owns the terminal, Ctrl-C cancels its query instead of ending the tunnel
+		cmd.Stdin, cmd.Stdout = nil, nil
+		detach(cmd)
+	}
+	// sshd greets first, a session that never answers has no SSH server behind it
+	var answered atomic.Bool
+	document, _ := sessionDocument()
+	sshSession := document == "AWS-StartSSHSession"
+	if sshSession {
+		cmd.Stdout = answerWriter{w: cmd.Stdout, answered: &answered}
+	}
 
 	slog.Info("session-manager-plugin start")
-	if err := cmd.Run(); err != nil {
-		slog.Error("session-manager-plugin error: %v", "error", err)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start session-manager-plugin: %v", err)
+	}
+	defer trackChild(cmd.Process)()
+	stopWatch := func() error { return nil }
+	if watched {
+		stopWatch = watchSession(sessionID, cmd, traffic, dbClientDone)
+	}
+	err = cmd.Wait()
+	limit := stopWatch()
+	if err := terminateSession(ssmClient(), sessionID); err != nil {
+		slog.Warn("failed to terminate session", "session_id", sessionID, "error", err)
+	}
+	if stopping() {
+		return errSessionStopped
+	}
+	if limit != nil {
+		return limit
+	}
+	if err != nil {
+		slog.Error("session-manager-plugin error", "error", err)
+		return fmt.Errorf("session-manager-plugin: %w", err)
+	}
+	// a plugin that exited cleanly without a byte from the port had nothing listening on it;
+	// a failing plugin is reported as it is
+	if sshSession && !answered.Load() {
+		return noSSHServer()
 	}
 	slog.Info("session-manager-plugin end")
 
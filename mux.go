@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// muxPersist is how long ssh keeps the master connection open after its last session ended
+const muxPersist = "10m"
+
+// muxCommands are the commands --mux applies to: those running ssh, scp or sftp, and those writing ssh_config.
+// The ProxyCommand itself can't share its session, ssh decides whether it is run at all.
+var muxCommands = []string{"cp", "sftp", "socks", "forward", "install", "ssh-config"}
+
+// controlPath returns ssh's ControlPath for the master connections, a socket in the state directory, which
+// only the user may enter. %C is ssh's hash of the local host, destination, port and user.
+func controlPath() string {
+	return cfg.StateDir + "/cm-%C"
+}
+
+// controlOptions returns the ssh options that make ssh connections to a host share the first one's
+// connection, and with it its SSM session, like ssh's ControlMaster. There are none without --mux.
+func controlOptions() [][2]string {
+	if !cfg.Mux {
+		return nil
+	}
+	return [][2]string{
+		{"ControlMaster", "auto"},
+		{"ControlPath", controlPath()},
+		{"ControlPersist", muxPersist},
+	}
+}
+
+// controlArgs returns the control options as ssh arguments
+func controlArgs() []string {
+	var args []string
+	for _, option := range controlOptions() {
+		args = append(args, "-o", option[0]+"="+option[1])
+	}
+	return args
+}
+
+// controlConfig returns the control options as ssh_config lines of a Host or Match block
+func controlConfig() string {
+	var b strings.Builder
+	for _, option := range controlOptions() {
+		value := option[1]
+		if strings.ContainsAny(value, " \t") {
+			value = `"` + value + `"`
+		}
+		fmt.Fprintf(&b, "  %s %s\n", option[0], value)
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var errNoTTY = errors.New("no controlling terminal")
+
+// pick shows items on the controlling terminal and returns the index of the selected one.
+// Since stdin/stdout carry the proxied SSH stream, all interaction goes through the terminal (/dev/tty).
+// Typing a number selects the item, any other text fuzzy-filters the list, and an empty line resets the filter.
+func pick(title string, items []string) (int, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return 0, errNoTTY
+	}
+	defer tty.Close()
+
+	all := make([]int, len(items))
+	for i := range items {
+		all[i] = i
+	}
+	visible := all
+
+	reader := bufio.NewReader(tty)
+	for {
+		fmt.Fprintln(tty, title)
+		for n, i := range visible {
+			fmt.Fprintf(tty, "%3d) %s\n", n+1, items[i])
+		}
+		fmt.Fprint(tty, "number to select, text to filter: ")
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, fmt.Errorf("failed to read selection: %v", err)
+		}
+		line = strings.TrimSpace(line)
+
+		if n, err := strconv.Atoi(line); err == nil && n >= 1 && n <= len(visible) {
+			return visible[n-1], nil
+		}
+
+		var filtered []int
+		for _, i := range all {
+			if fuzzyMatch(line, items[i]) {
+				filtered = append(filtered, i)
+			}
+		}
+		switch len(filtered) {
+		case 0:
+			fmt.Fprintf(tty, "nothing matches %q\n", line)
+			visible = all
+		case 1:
+			return filtered[0], nil
+		default:
+			visible = filtered
+		}
+	}
+}
+
+// fuzzyMatch reports whether all characters of pattern appear in s in the same order (case-insensitive)
+func fuzzyMatch(pattern, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	for _, r := range pattern {
+		if r == ' ' {
+			continue
+		}
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(r):]
+	}
+	return true
+}
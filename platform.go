@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"os"
+)
+
+const (
+	platformLinux   = "linux"
+	platformWindows = "windows"
+)
+
+// platformOf returns the instance's platform, EC2 only reports it for Windows instances
+func platformOf(instance ec2Types.Instance) string {
+	if instance.Platform == ec2Types.PlatformValuesWindows {
+		return platformWindows
+	}
+	return platformLinux
+}
+
+func validatePlatform(platform string) error {
+	switch platform {
+	case "", platformLinux, platformWindows:
+		return nil
+	}
+	return fmt.Errorf("invalid platform %q, expected %s or %s", platform, platformLinux, platformWindows)
+}
+
+// filterPlatform keeps only instances of the given platform (all of them if platform is empty)
+func filterPlatform(instances []ec2Types.Instance, platform string) []ec2Types.Instance {
+	if platform == "" {
+		return instances
+	}
+	var result []ec2Types.Instance
+	for _, instance := range instances {
+		if platformOf(instance) == platform {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// sessionDocument returns the session document and its parameters for the target.
+// SSH goes through AWS-StartSSHSession on every platform (Windows targets need OpenSSH Server).
+// The shell command, or running the tool directly from a terminal rather than as an ssh ProxyCommand,
+// starts a plain shell session instead, which needs neither sshd nor an authorized key.
+// A port forward uses its own document. A custom document (e.g. an org-specific one with logging or
+// a restricted shell) replaces AWS-StartSSHSession and gets exactly the parameters given for it.
+func sessionDocument() (string, map[string][]string) {
+	if len(cfg.Forwards) == 1 {
+		return forwardDocument(cfg.Forwards[0])
+	}
+	if cfg.Shell {
+		return "SSM-SessionManagerRunShell", map[string][]string{}
+	}
+	if cfg.Document != "" {
+		parameters := map[string][]string(cfg.Parameters)
+		if parameters == nil {
+			parameters = map[string][]string{}
+		}
+		return cfg.Document, parameters
+	}
+	return "AWS-StartSSHSession", map[string][]string{"portNumber": {cfg.Port}}
+}
+
+// isTerminal reports whether f is a terminal (ssh hands a pipe to its ProxyCommand)
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+// pluginPaths are where the session-manager-plugin installers put the binary
+var pluginPaths = []string{
+	"/usr/local/bin/session-manager-plugin",    // default
+	"/usr/bin/session-manager-plugin",          // linux
+	"/opt/homebrew/bin/session-manager-plugin", // macos (homebrew)
+}
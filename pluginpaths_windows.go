@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// pluginPaths are where the session-manager-plugin installer puts the binary
+var pluginPaths = []string{
+	filepath.Join(os.Getenv("ProgramFiles"), "Amazon", "SessionManagerPlugin", "bin", "session-manager-plugin.exe"),
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+)
+
+// setupProxy routes AWS API calls and the session stream through an egress proxy.
+// Both the SDK's HTTP client and the session-manager-plugin read HTTPS_PROXY/NO_PROXY
+// from the environment, so --proxy is exported as HTTPS_PROXY for this process and the plugin.
+func setupProxy(proxy string) error {
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", u.Scheme)
+		}
+		os.Setenv("HTTPS_PROXY", proxy)
+	}
+
+	if p := firstEnv("HTTPS_PROXY", "https_proxy"); p != "" {
+		slog.Info("using proxy", "proxy", p, "no_proxy", firstEnv("NO_PROXY", "no_proxy"))
+	}
+	return nil
+}
+
+// firstEnv returns the value of the first set environment variable
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
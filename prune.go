@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPruneAfter is how old cache entries, cached credentials and log entries get before they are
+	// pruned, unless the config file says otherwise
+	defaultPruneAfter = 30 * 24 * time.Hour
+	// defaultMaxStorageMB caps the cache and state directories together, unless the config file says otherwise
+	defaultMaxStorageMB = 10
+	// pruneInterval is how often pruning runs, the mtime of pruneMarker records the last run
+	pruneInterval = 24 * time.Hour
+	pruneMarker   = "pruned"
+)
+
+// pruneDue reports whether pruning last ran longer than pruneInterval ago
+func pruneDue(stateDir string, now time.Time) bool {
+	info, err := os.Stat(filepath.Join(stateDir, pruneMarker))
+	return err != nil || now.Sub(info.ModTime()) > pruneInterval
+}
+
+// prune drops what is older than maxAge from the cache and the logs, then the oldest cache entries and
+// audit log entries while the cache and state directories together take more than maxSize bytes.
+// A maxAge or maxSize of 0 leaves that part out.
+func prune(cacheDir, stateDir string, maxAge time.Duration, maxSize int64, now time.Time) error {
+	cutoff := time.Time{}
+	if maxAge > 0 {
+		cutoff = now.Add(-maxAge)
+	}
+	auditPath := filepath.Join(stateDir, "audit.log")
+
+	// credentials, mux records of sessions long gone, lookup and push locks of targets not used since
+	// and a log nothing was written to
+	if maxAge > 0 {
+		for _, pattern := range []string{
+			filepath.Join(cacheDir, "*-credentials.json"),
+			filepath.Join(stateDir, "mux-*"),
+			filepath.Join(stateDir, "resolve-*.lock"),
+			filepath.Join(stateDir, "push-*.lock"),
+			filepath.Join(stateDir, "ssm-ssh-connect.log"),
+		} {
+			paths, _ := filepath.Glob(pattern)
+			for _, path := range paths {
+				if info, err := os.Stat(path); err == nil && info.ModTime().Before(cutoff) {
+					os.Remove(path)
+				}
+			}
+		}
+	}
+
+	excess := int64(0)
+	if maxSize > 0 {
+		excess = dirSize(cacheDir) - maxSize
+		// on Windows the state directory is inside the cache directory
+		if !strings.HasPrefix(stateDir, cacheDir+string(filepath.Separator)) {
+			excess += dirSize(stateDir)
+		}
+	}
+	err := updateCacheDB(cacheDir, func(db *cacheDB) {
+		db.PushedKeys.prune(now)
+		excess -= pruneCacheDB(db, cutoff, excess, now)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to prune the cache: %v", err)
+	}
+	if err := pruneAuditLog(auditPath, cutoff, excess); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, pruneMarker), nil, 0600)
+}
+
+// pruneCacheDB drops entries saved before cutoff and remembered misses that lapsed, then the oldest
+// entries until about excess bytes are freed. It returns the bytes freed.
+func pruneCacheDB(db *cacheDB, cutoff time.Time, excess int64, now time.Time) int64 {
+	freed := int64(0)
+	drop := func(key string) {
+		data, _ := json.Marshal(db.Entries[key])
+		// the key, its quotes, colon and comma
+		freed += int64(len(data) + len(key) + 4)
+		delete(db.Entries, key)
+	}
+	var keys []string
+	for key, entry := range db.Entries {
+		switch {
+		case entry.Saved.Before(cutoff), entry.NotFound && now.Sub(entry.Saved) > notFoundCacheTTL:
+			drop(key)
+		default:
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return db.Entries[a].Saved.Compare(db.Entries[b].Saved)
+	})
+	for _, key := range keys {
+		if freed >= excess {
+			break
+		}
+		drop(key)
+	}
+	return freed
+}
+
+// pruneAuditLog drops the audit log's entries before cutoff, then the oldest ones until excess bytes are freed.
+// It holds the lock appendAuditLog writes under. Entries dropped for the size are logged, they were still due to be kept.
+func pruneAuditLog(path string, cutoff time.Time, excess int64) error {
+	unlock, err := lock(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	defer unlock()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var kept [][]byte
+	freed, capped := int64(0), 0
+	var cappedUntil time.Time
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var entry auditEntry
+		if json.Unmarshal(line, &entry) == nil && (entry.Time.Before(cutoff) || freed < excess) {
+			freed += int64(len(line) + 1)
+			if !entry.Time.Before(cutoff) {
+				capped++
+				cappedUntil = entry.Time
+			}
+			continue
+		}
+		kept = append(kept, append([]byte(nil), line...))
+	}
+	if freed == 0 {
+		return nil
+	}
+	if capped > 0 {
+		slog.Warn("dropped audit log entries over the storage cap", "entries", capped, "until", cappedUntil)
+	}
+	pruned := bytes.Join(kept, []byte("\n"))
+	if len(pruned) > 0 {
+		pruned = append(pruned, '\n')
+	}
+	if err := replaceFile(path, pruned, 0600); err != nil {
+		return fmt.Errorf("failed to prune the audit log: %v", err)
+	}
+	return nil
+}
+
+// dirSize returns the size of the files in the directory and below, leaving out the lock files
+func dirSize(dir string) int64 {
+	size := int64(0)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// rdpClientTimeout bounds the wait for the forwarded RDP port before giving up on launching the client
+const rdpClientTimeout = 30 * time.Second
+
+// rdpClientCommand returns the command that opens the platform's RDP client on the local port
+func rdpClientCommand(goos, localPort string) (*exec.Cmd, error) {
+	address := "localhost:" + localPort
+	switch goos {
+	case "darwin":
+		return exec.Command("open", "rdp://full%20address=s:"+address), nil
+	case "windows":
+		return exec.Command("mstsc", "/v:"+address), nil
+	case "linux":
+		return exec.Command("xfreerdp", "/v:"+address), nil
+	}
+	return nil, fmt.Errorf("no known RDP client on %s, connect to %s yourself", goos, address)
+}
+
+// launchRDPClient waits until the port forward accepts connections and then opens the RDP client
+func launchRDPClient(localPort string) {
+	if err := waitForPort(localPort, rdpClientTimeout); err != nil {
+		slog.Warn("RDP port forward did not come up, not launching the RDP client", "error", err)
+		return
+	}
+
+	cmd, err := rdpClientCommand(runtime.GOOS, localPort)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		slog.Warn("failed to launch RDP client", "error", err)
+		fmt.Fprintf(os.Stderr, "Failed to launch RDP client: %v\n", err)
+	}
+}
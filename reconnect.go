@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+	// reconnectMaxAttempts is how often in a row a session is restarted that didn't last, before giving up
+	reconnectMaxAttempts = 10
+)
+
+// runSession starts the session and, with --reconnect, restarts it when the session-manager-plugin
+// exits because the connection dropped (laptop sleep, network change). Port forwards never end on
+// their own, so they are restarted whenever the plugin exits; shells only when it exits with an error.
+// An ssh connection can't survive a new session (sshd sees a new TCP connection), so ssh sessions aren't restarted.
+// Errors a new attempt won't fix, such as denied access, expired credentials or an invalid document, end it,
+// as do reconnectMaxAttempts sessions in a row that ended within reconnectMaxDelay.
+func runSession(reconnect, forward bool) error {
+	delay := reconnectMinDelay
+	attempts := 0
+	for {
+		started := time.Now()
+		err := startSSMSessionWithPlugin()
+		if !reconnect || stopping() || errors.Is(err, errSessionLimit) || (err == nil && !forward) {
+			return err
+		}
+		if !reconnectable(err) {
+			return err
+		}
+
+		// a session that ran for a while dropped for a new reason, start over with a short delay
+		if time.Since(started) > reconnectMaxDelay {
+			delay = reconnectMinDelay
+			attempts = 0
+		}
+		attempts++
+		if attempts > reconnectMaxAttempts {
+			return fmt.Errorf("giving up after %d attempts to reconnect: %w", reconnectMaxAttempts, err)
+		}
+		slog.Warn("session ended, reconnecting", "error", err, "delay", delay, "attempt", attempts)
+		fmt.Fprintf(os.Stderr, "Session ended, reconnecting in %v...\n", delay)
+		time.Sleep(delay)
+		delay = min(delay*2, reconnectMaxDelay)
+
+		if err := checkSSMOnline(); err != nil && !instanceIDPattern.MatchString(cfg.InstanceName) {
+			// the target may have been replaced, e.g. by its Auto Scaling group
+			slog.Info("instance is not available, resolving the target again", "error", err)
+			// the previous instance is kept to retry with until a lookup succeeds
+			previous := cfg
+			cfg.InstanceID = ""
+			if err := getInstanceDetails(); err != nil {
+				slog.Warn("failed to resolve the target again", "error", err)
+				cfg = previous
+			}
+			awsConfig.Region = cfg.Region
+			// the new instance needs the key too, when the session pushes one
+			if cfg.InstanceID != previous.InstanceID && keyPushSkipReason(sessionCommand(forward)) == "" {
+				if err := sendSSHPublicKey(); err != nil {
+					slog.Warn("failed to send SSH public key", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// sessionCommand is the command of a session runSession restarts
+func sessionCommand(forward bool) string {
+	if forward {
+		return "forward"
+	}
+	return ""
+}
+
+// reconnectable reports whether a new session may succeed where this one failed: the session ran and the
+// plugin exited, the connection or the service failed transiently, or the instance went away and is
+// resolved again
+func reconnectable(err error) bool {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil, errors.As(err, &exitErr), staleInstance(err):
+		return true
+	}
+	retryables := append(slices.Clone(retry.DefaultRetryables), retry.RetryableErrorCode{Codes: transientErrorCodes})
+	return retry.IsErrorRetryables(retryables).IsErrorRetryable(err) == aws.TrueTernary
+}
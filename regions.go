@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"log/slog"
+	"sync"
+)
+
+// describeInstancesInAllRegions runs the same DescribeInstances query in every enabled region
+// (except the default one, which was already searched) in parallel. A region that fails is skipped,
+// but when no region answered the errors are returned rather than no match.
+func describeInstancesInAllRegions(input *ec2.DescribeInstancesInput) ([]ec2Types.Instance, error) {
+	client := ec2Client()
+	ctx, cancel := apiContext()
+	defer cancel()
+	regions, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe regions: %v", err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		instances []ec2Types.Instance
+		searched  int
+		errs      []error
+	)
+	for _, region := range regions.Regions {
+		name := aws.ToString(region.RegionName)
+		if name == awsConfig.Region {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			regionalClient := ec2Client(func(o *ec2.Options) {
+				o.Region = name
+			})
+			regionalInput := *input
+			found, err := describeInstances(regionalClient, &regionalInput)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case instanceIDNotFound(err):
+				searched++
+			case err != nil:
+				slog.Warn("failed to search region", "region", name, "error", err)
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			default:
+				searched++
+				instances = append(instances, found...)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if searched == 0 && len(errs) > 0 {
+		return nil, fmt.Errorf("failed to search all regions: %w", errors.Join(errs...))
+	}
+	return instances, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+)
+
+// resolvers look targets up: ec2 with DescribeInstances, ssm in Systems Manager's inventory
+const (
+	resolverEC2 = "ec2"
+	resolverSSM = "ssm"
+)
+
+func validateResolver(resolver string) error {
+	switch resolver {
+	case resolverEC2, resolverSSM:
+		return nil
+	}
+	return fmt.Errorf("invalid resolver %q, expected %s or %s", resolver, resolverEC2, resolverSSM)
+}
+
+// getSSMInstanceDetails looks the target up in Systems Manager's inventory instead of EC2, which takes only
+// ssm:DescribeInstanceInformation and finds hybrid instances by name too. The inventory filters on the Name
+// tag but has no other tags and no AZs: globs, fleet targets and the tag, VPC and subnet selectors need the
+// ec2 resolver, and the instance is taken to live in the profile's region.
+func getSSMInstanceDetails(target string, index int) error {
+	for _, prefix := range []string{"asg:", "ecs:", "eks:", "cfn:"} {
+		if strings.HasPrefix(target, prefix) {
+			return fmt.Errorf("%s targets need the %s resolver", prefix, resolverEC2)
+		}
+	}
+	if strings.ContainsAny(target, "*?") {
+		return fmt.Errorf("name globs need the %s resolver", resolverEC2)
+	}
+	if len(cfg.Excludes) > 0 || cfg.VpcID != "" || cfg.SubnetID != "" {
+		return fmt.Errorf("--exclude, --vpc and --subnet need the %s resolver", resolverEC2)
+	}
+
+	input := &ssm.DescribeInstanceInformationInput{}
+	// IP addresses and host names are matched on what the agent reports, the inventory can't filter on them
+	var match func(ssmTypes.InstanceInformation) bool
+	switch {
+	case instanceIDPattern.MatchString(target):
+		input.Filters = append(input.Filters, ssmTypes.InstanceInformationStringFilter{
+			Key:    aws.String("InstanceIds"),
+			Values: []string{target},
+		})
+	case net.ParseIP(target) != nil:
+		match = func(info ssmTypes.InstanceInformation) bool {
+			ip := net.ParseIP(aws.ToString(info.IPAddress))
+			return ip != nil && ip.Equal(net.ParseIP(target))
+		}
+	case privateDNSPattern.MatchString(target):
+		match = func(info ssmTypes.InstanceInformation) bool {
+			return strings.EqualFold(aws.ToString(info.ComputerName), target)
+		}
+	default:
+		input.Filters = append(input.Filters, ssmTypes.InstanceInformationStringFilter{
+			Key:    aws.String("tag:Name"),
+			Values: []string{target},
+		})
+	}
+	switch cfg.PlatformOnly {
+	case platformLinux:
+		input.Filters = append(input.Filters, ssmTypes.InstanceInformationStringFilter{
+			Key:    aws.String("PlatformTypes"),
+			Values: []string{string(ssmTypes.PlatformTypeLinux)},
+		})
+	case platformWindows:
+		input.Filters = append(input.Filters, ssmTypes.InstanceInformationStringFilter{
+			Key:    aws.String("PlatformTypes"),
+			Values: []string{string(ssmTypes.PlatformTypeWindows)},
+		})
+	}
+
+	var instances []ssmTypes.InstanceInformation
+	paginator := ssm.NewDescribeInstanceInformationPaginator(ssmClient(), input)
+	for paginator.HasMorePages() {
+		ctx, cancel := apiContext()
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to describe instance information: %v", err)
+		}
+		for _, info := range page.InstanceInformationList {
+			if match == nil || match(info) {
+				instances = append(instances, info)
+			}
+		}
+	}
+	if len(instances) == 0 {
+		return errInstanceNotFound
+	}
+	rankInstanceInformation(instances)
+
+	instance := instances[0]
+	switch {
+	case index > 0:
+		// the inventory has no launch time, the registration comes closest
+		sort.SliceStable(instances, func(i, j int) bool {
+			return aws.ToTime(instances[i].RegistrationDate).Before(aws.ToTime(instances[j].RegistrationDate))
+		})
+		if index > len(instances) {
+			return fmt.Errorf("instance #%d requested, but only %d instances match %q", index, len(instances), target)
+		}
+		instance = instances[index-1]
+	case len(instances) > 1:
+		items := make([]string, len(instances))
+		for i, info := range instances {
+			items[i] = fmt.Sprintf("%-20s %-14s %-16s %s", aws.ToString(info.InstanceId), info.PingStatus,
+				aws.ToString(info.IPAddress), aws.ToString(info.ComputerName))
+		}
+		i, err := pick(fmt.Sprintf("multiple instances match %q:", cfg.InstanceName), items)
+		if errors.Is(err, errNoTTY) {
+			slog.Warn("multiple instances match and there is no terminal to choose from, using the last one seen online", "count", len(instances))
+		} else if err != nil {
+			return err
+		} else {
+			instance = instances[i]
+		}
+	}
+
+	cfg.InstanceID = aws.ToString(instance.InstanceId)
+	cfg.InstanceAZ = ""
+	cfg.Region = awsConfig.Region
+	cfg.Hybrid = instance.ResourceType != ssmTypes.ResourceTypeEc2Instance
+	cfg.Platform = platformLinux
+	if instance.PlatformType == ssmTypes.PlatformTypeWindows {
+		cfg.Platform = platformWindows
+	}
+	return nil
+}
+
+// rankInstanceInformation orders the matches online first, then by the agent's last ping, newest first,
+// with the instance ID breaking ties
+func rankInstanceInformation(instances []ssmTypes.InstanceInformation) {
+	sort.SliceStable(instances, func(i, j int) bool {
+		oi := instances[i].PingStatus == ssmTypes.PingStatusOnline
+		oj := instances[j].PingStatus == ssmTypes.PingStatusOnline
+		if oi != oj {
+			return oi
+		}
+		pi, pj := aws.ToTime(instances[i].LastPingDateTime), aws.ToTime(instances[j].LastPingDateTime)
+		if !pi.Equal(pj) {
+			return pi.After(pj)
+		}
+		return aws.ToString(instances[i].InstanceId) < aws.ToString(instances[j].InstanceId)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRetries is how often a call failing with a transient error is retried unless given otherwise
+	defaultRetries = 3
+	// maxRetryBackoff caps the wait before a retry, the ssh handshake is waiting
+	maxRetryBackoff = 5 * time.Second
+)
+
+// transientErrorCodes are retried besides the throttling, timeout and 5xx errors every AWS client retries
+var transientErrorCodes = map[string]struct{}{
+	// EC2 Instance Connect briefly can't reach an instance that just started or is busy
+	"EC2InstanceUnavailableException": {},
+	"ServiceUnavailableException":     {},
+	"InternalServerException":         {},
+}
+
+// apiRetryer returns the retryer of the AWS clients, which retries DescribeInstances, SendSSHPublicKey,
+// StartSession and every other call failing with a transient error up to retries times, with jittered
+// exponential backoff, or as long as a throttled response's Retry-After asks. Without the client-side
+// retry quota, a burst of throttled connections still gets its retries.
+func apiRetryer(retries int) func() aws.Retryer {
+	return func() aws.Retryer {
+		return retryAfterRetryer{retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = retries + 1
+			o.MaxBackoff = maxRetryBackoff
+			o.RateLimiter = ratelimit.None
+			o.Retryables = append(o.Retryables, retry.RetryableErrorCode{Codes: transientErrorCodes})
+		})}
+	}
+}
+
+// retryAfterRetryer waits at least as long as the response's Retry-After header asks before a retry
+type retryAfterRetryer struct {
+	aws.RetryerV2
+}
+
+func (r retryAfterRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	delay, delayErr := r.RetryerV2.RetryDelay(attempt, err)
+	if delayErr != nil {
+		return delay, delayErr
+	}
+	if after, ok := retryAfter(err, time.Now()); ok && after > delay {
+		return after, nil
+	}
+	return delay, nil
+}
+
+// retryAfter returns the wait the response of the failed call asks for in its Retry-After header,
+// given in seconds or as a date
+func retryAfter(err error, now time.Time) (time.Duration, bool) {
+	var responseErr *awshttp.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.Response == nil || responseErr.Response.Response == nil {
+		return 0, false
+	}
+	header := responseErr.Response.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// runPollInterval is how often the command invocation is polled for completion
+const runPollInterval = time.Second
+
+// maxCommentLength is the longest comment SendCommand accepts
+const maxCommentLength = 100
+
+// runOutputLimit is how many characters of each output stream GetCommandInvocation returns, the rest is cut off
+const runOutputLimit = 24000
+
+// runDocument returns the Run Command document for the instance's platform
+func runDocument() string {
+	if cfg.Platform == platformWindows {
+		return "AWS-RunPowerShellScript"
+	}
+	return "AWS-RunShellScript"
+}
+
+// runCommand runs a single command on the target through SSM Run Command, writes its output once it
+// finished and returns the remote exit code. Unlike a session, Run Command keeps stdout and stderr apart and
+// reports the exit code, but it returns at most runOutputLimit characters of each, which is warned about.
+func runCommand(command string, stdout, stderr io.Writer) (int, error) {
+	client := ssmClient()
+
+	document := runDocument()
+	ctx, cancel := apiContext()
+	defer cancel()
+	result, err := client.SendCommand(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String(document),
+		InstanceIds:  []string{cfg.InstanceID},
+		Parameters:   map[string][]string{"commands": {command}},
+		Comment:      aws.String(runComment(cfg.Reason)),
+	})
+	if err != nil {
+		return 1, fmt.Errorf("failed to send command: %v", err)
+	}
+	connected()
+	audit(auditEntry{
+		InstanceID: cfg.InstanceID,
+		Region:     cfg.Region,
+		Document:   document,
+		CommandID:  aws.ToString(result.Command.CommandId),
+	})
+	commandID := result.Command.CommandId
+	slog.Info("command sent", "command_id", aws.ToString(commandID))
+
+	for {
+		time.Sleep(runPollInterval)
+
+		ctx, cancel := apiContext()
+		invocation, err := client.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  commandID,
+			InstanceId: aws.String(cfg.InstanceID),
+		})
+		cancel()
+		if err != nil {
+			// the invocation shows up shortly after SendCommand returns
+			var notYet *ssmTypes.InvocationDoesNotExist
+			if errors.As(err, &notYet) {
+				continue
+			}
+			return 1, fmt.Errorf("failed to get command invocation: %v", err)
+		}
+
+		switch invocation.Status {
+		case ssmTypes.CommandInvocationStatusPending, ssmTypes.CommandInvocationStatusInProgress,
+			ssmTypes.CommandInvocationStatusDelayed, ssmTypes.CommandInvocationStatusCancelling:
+			continue
+		}
+
+		fmt.Fprint(stdout, aws.ToString(invocation.StandardOutputContent))
+		fmt.Fprint(stderr, aws.ToString(invocation.StandardErrorContent))
+		for _, stream := range []struct {
+			name    string
+			content *string
+		}{{"stdout", invocation.StandardOutputContent}, {"stderr", invocation.StandardErrorContent}} {
+			if outputTruncated(aws.ToString(stream.content)) {
+				slog.Warn("command output truncated", "stream", stream.name, "limit", runOutputLimit)
+				fmt.Fprintf(stderr, "Warning: %s was cut off after %d characters by Run Command, use ssh for longer output\n", stream.name, runOutputLimit)
+			}
+		}
+		slog.Info("command finished", "status", invocation.Status, "exit_code", invocation.ResponseCode)
+
+		if invocation.Status == ssmTypes.CommandInvocationStatusSuccess {
+			return 0, nil
+		}
+		if invocation.ResponseCode > 0 {
+			return int(invocation.ResponseCode), nil
+		}
+		// timed out or cancelled before the command could report an exit code
+		return 1, fmt.Errorf("command %s", invocation.Status)
+	}
+}
+
+// outputTruncated reports whether Run Command cut the output off at runOutputLimit characters
+func outputTruncated(content string) bool {
+	return utf8.RuneCountInString(content) >= runOutputLimit
+}
+
+// runComment returns the comment of the command, which carries the reason as far as the 100 characters SendCommand accepts allow
+func runComment(reason string) string {
+	comment := "ssm-ssh-connect run"
+	if reason != "" {
+		comment += ": " + reason
+	}
+	if len(comment) > maxCommentLength {
+		comment = strings.ToValidUTF8(comment[:maxCommentLength], "")
+	}
+	return comment
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releasesURL is the GitHub API endpoint of the latest release
+const releasesURL = "https://api.github.com/repos/scmrus/ssm-ssh-connect/releases/latest"
+
+// checksumsAsset is the release asset listing the SHA-256 checksums of the archives, as sha256sum prints them
+const checksumsAsset = "checksums.txt"
+
+// release is the part of the GitHub release the update needs
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetURL returns the download URL of the release asset
+func (r release) assetURL(name string) (string, error) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no %s", r.TagName, name)
+}
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// download returns the body of the URL
+func download(url string) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// releaseVersion returns the dotted version of a release tag such as v1.2.3, or "" for anything else,
+// e.g. a dev build or the pseudo-version go install records for a commit
+func releaseVersion(tag string) string {
+	v := strings.TrimPrefix(tag, "v")
+	for _, field := range strings.Split(v, ".") {
+		if _, err := strconv.Atoi(field); err != nil {
+			return ""
+		}
+	}
+	return v
+}
+
+// updateDue reports whether the latest release is newer than the running one. A build that isn't a
+// release can't be compared and is not replaced.
+func updateDue(current, latest string) (bool, error) {
+	if releaseVersion(current) == "" {
+		return false, notReleaseBuild(current)
+	}
+	if releaseVersion(latest) == "" {
+		return false, fmt.Errorf("the latest release %q has no version", latest)
+	}
+	return olderVersion(releaseVersion(current), releaseVersion(latest)), nil
+}
+
+func notReleaseBuild(current string) error {
+	return fmt.Errorf("ssm-ssh-connect %s is not a release build, install a release to update it", current)
+}
+
+// selfUpdate replaces the running binary with that of the latest release, if that is newer, after
+// checking the archive against the release's checksums
+func selfUpdate(w io.Writer, current string) error {
+	// no release to look up for a build from source
+	if releaseVersion(current) == "" {
+		return notReleaseBuild(current)
+	}
+	data, err := download(releasesURL)
+	if err != nil {
+		return fmt.Errorf("failed to look up the latest release: %v", err)
+	}
+	var latest release
+	if err := json.Unmarshal(data, &latest); err != nil {
+		return fmt.Errorf("failed to parse the latest release: %v", err)
+	}
+	due, err := updateDue(current, latest.TagName)
+	if err != nil {
+		return err
+	}
+	if !due {
+		// the latest release may also be older, after a release was withdrawn
+		fmt.Fprintf(w, "ssm-ssh-connect %s is up to date, the latest release is %s\n", current, latest.TagName)
+		return nil
+	}
+
+	archiveName := fmt.Sprintf("ssm-ssh-connect-%s-%s.tar.gz", runtime.GOOS, runtime.GOARCH)
+	archiveURL, err := latest.assetURL(archiveName)
+	if err != nil {
+		return err
+	}
+	checksumsURL, err := latest.assetURL(checksumsAsset)
+	if err != nil {
+		return err
+	}
+	checksums, err := download(checksumsURL)
+	if err != nil {
+		return fmt.Errorf("failed to download checksums: %v", err)
+	}
+	archive, err := download(archiveURL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", archiveName, err)
+	}
+	if err := verifyChecksum(archive, archiveName, string(checksums)); err != nil {
+		return err
+	}
+	binary, err := extractBinary(archive)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find own executable: %v", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return fmt.Errorf("failed to find own executable: %v", err)
+	}
+	if runtime.GOOS == "windows" {
+		// Windows doesn't replace a running executable, but lets it be renamed
+		os.Remove(executable + ".old")
+		if err := os.Rename(executable, executable+".old"); err != nil {
+			return fmt.Errorf("failed to move %s aside: %v", executable, err)
+		}
+	}
+	if err := replaceFile(executable, binary, 0755); err != nil {
+		if runtime.GOOS == "windows" {
+			// put the running binary back rather than leave no ssm-ssh-connect.exe at all
+			if restoreErr := os.Rename(executable+".old", executable); restoreErr != nil {
+				return fmt.Errorf("%v, and failed to restore %s from %s.old: %v", err, executable, executable, restoreErr)
+			}
+		}
+		return err
+	}
+	fmt.Fprintf(w, "Updated ssm-ssh-connect %s to %s\n", current, latest.TagName)
+	return nil
+}
+
+// verifyChecksum checks the data against the checksum of the name in sha256sum output
+func verifyChecksum(data []byte, name, checksums string) error {
+	for _, line := range strings.Split(checksums, "\n") {
+		fields := strings.Fields(line)
+		// sha256sum marks files read in binary mode with *
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != name {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != strings.ToLower(fields[0]) {
+			return fmt.Errorf("checksum mismatch for %s", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("no checksum for %s", name)
+}
+
+// extractBinary returns the ssm-ssh-connect binary of the release archive
+func extractBinary(archive []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read release archive: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("release archive has no ssm-ssh-connect binary")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read release archive: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg && strings.TrimSuffix(filepath.Base(header.Name), ".exe") == "ssm-ssh-connect" {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// replaceFile atomically replaces the file with the data, by renaming a file written next to it
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ssm-ssh-connect-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"io"
+	"regexp"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// sessionIDPattern matches Session Manager session IDs, the owner's name with a random suffix,
+// which tells them apart from the profile argument
+var sessionIDPattern = regexp.MustCompile(`^.+-[0-9a-f]{17}$`)
+
+// allSessions terminates all of the caller's active sessions
+const allSessions = "all"
+
+// splitSessionArgs splits the arguments of sessions terminate into the profile, if one is given, and the sessions
+func splitSessionArgs(args []string) (profile string, sessionIDs []string) {
+	if len(args) > 0 && args[0] != allSessions && !sessionIDPattern.MatchString(args[0]) {
+		return args[0], args[1:]
+	}
+	return "", args
+}
+
+// sessionRow is a line of the session list
+type sessionRow struct {
+	SessionID string    `json:"session_id"`
+	Target    string    `json:"target"`
+	Started   time.Time `json:"started"`
+	Document  string    `json:"document,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// activeSessions returns the caller's active Session Manager sessions in the region, oldest first,
+// e.g. those left behind by a crash or a laptop that went to sleep
+func activeSessions() ([]sessionRow, error) {
+	ctx, cancel := apiContext()
+	identity, err := sts.NewFromConfig(awsConfig).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller identity: %v", err)
+	}
+
+	var rows []sessionRow
+	paginator := ssm.NewDescribeSessionsPaginator(ssmClient(), &ssm.DescribeSessionsInput{
+		State: ssmTypes.SessionStateActive,
+		Filters: []ssmTypes.SessionFilter{
+			{Key: ssmTypes.SessionFilterKeyOwner, Value: identity.Arn},
+		},
+	})
+	for paginator.HasMorePages() {
+		ctx, cancel := apiContext()
+		page, err := paginator.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe sessions: %v", err)
+		}
+		for _, session := range page.Sessions {
+			rows = append(rows, sessionRow{
+				SessionID: aws.ToString(session.SessionId),
+				Target:    aws.ToString(session.Target),
+				Started:   aws.ToTime(session.StartDate),
+				Document:  aws.ToString(session.DocumentName),
+				Reason:    aws.ToString(session.Reason),
+			})
+		}
+	}
+	slices.SortStableFunc(rows, func(a, b sessionRow) int { return a.Started.Compare(b.Started) })
+	return rows, nil
+}
+
+// writeSessions writes the session list as a table with the sessions' age, or as a JSON array for other tools
+func writeSessions(w io.Writer, rows []sessionRow, output string, now time.Time) error {
+	if output == outputJSON {
+		if rows == nil {
+			rows = []sessionRow{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION ID\tTARGET\tAGE\tDOCUMENT\tREASON")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\n", row.SessionID, row.Target, now.Sub(row.Started).Truncate(time.Second), row.Document, row.Reason)
+	}
+	return tw.Flush()
+}
+
+// terminateSessions terminates the sessions, all active ones of the caller for all, or the one chosen on
+// the terminal when none are given
+func terminateSessions(w io.Writer, sessionIDs []string) error {
+	if len(sessionIDs) == 0 || slices.Contains(sessionIDs, allSessions) {
+		rows, err := activeSessions()
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			fmt.Fprintln(w, "No active sessions")
+			return nil
+		}
+		if len(sessionIDs) == 0 {
+			now := time.Now()
+			items := make([]string, len(rows))
+			for i, row := range rows {
+				items[i] = fmt.Sprintf("%-40s %-22s %v", row.SessionID, row.Target, now.Sub(row.Started).Truncate(time.Second))
+			}
+			i, err := pick("session to terminate:", items)
+			if errors.Is(err, errNoTTY) {
+				return fmt.Errorf("no terminal to choose on, give the session IDs to terminate, or %s", allSessions)
+			}
+			if err != nil {
+				return err
+			}
+			rows = rows[i : i+1]
+		}
+		sessionIDs = nil
+		for _, row := range rows {
+			sessionIDs = append(sessionIDs, row.SessionID)
+		}
+	}
+
+	client := ssmClient()
+	var failed []error
+	for _, sessionID := range sessionIDs {
+		if err := terminateSession(client, sessionID); err != nil {
+			failed = append(failed, fmt.Errorf("failed to terminate %s: %v", sessionID, err))
+			continue
+		}
+		fmt.Fprintf(w, "Terminated %s\n", sessionID)
+	}
+	return errors.Join(failed...)
+}
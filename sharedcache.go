@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// sharedCacheTimeout bounds a request to the shared cache, which is only worth asking while it is
+// faster than looking the instance up
+const sharedCacheTimeout = 3 * time.Second
+
+var errSharedCacheMiss = errors.New("not in the shared cache")
+
+// sharedCache is a resolution cache in an S3 prefix a team shares, one object per target.
+// The prefix belongs to one account, since names resolve differently in another.
+type sharedCache struct {
+	Bucket string
+	Prefix string
+	// Endpoint replaces the bucket's virtual host, with the bucket in the path, e.g. for a VPC endpoint
+	Endpoint string
+}
+
+// parseSharedCache parses an s3://bucket/prefix URI
+func parseSharedCache(uri, endpoint string) (sharedCache, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return sharedCache{}, fmt.Errorf("invalid shared cache %q, expected s3://bucket/prefix", uri)
+	}
+	return sharedCache{Bucket: u.Host, Prefix: strings.Trim(u.Path, "/"), Endpoint: endpoint}, nil
+}
+
+// sharedCacheKey identifies the target's entry for the whole team. Unlike the local key it leaves out the
+// profile and the user, which differ between people but don't change what a name resolves to.
+func sharedCacheKey(cfg *Config) string {
+	return fileSafeName(cfg.InstanceName) + selectorSuffix(cfg)
+}
+
+// client creates an S3 client for the bucket's region, honouring the custom endpoint with the bucket in the path
+func (c sharedCache) client(region string) *s3.Client {
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.Region = region
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+}
+
+// do gets the key's object, or puts it when body is given, following the bucket to its region
+func (c sharedCache) do(key string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sharedCacheTimeout)
+	defer cancel()
+	name := path.Join(c.Prefix, key+".json")
+
+	region := awsConfig.Region
+	for redirected := false; ; redirected = true {
+		data, err := c.request(ctx, region, name, body)
+		var respErr *awshttp.ResponseError
+		if !errors.As(err, &respErr) {
+			return data, err
+		}
+		bucketRegion := respErr.Response.Header.Get("X-Amz-Bucket-Region")
+		switch {
+		case respErr.HTTPStatusCode() == http.StatusNotFound:
+			return nil, errSharedCacheMiss
+		case !redirected && bucketRegion != "" && bucketRegion != region:
+			region = bucketRegion
+			continue
+		}
+		return nil, err
+	}
+}
+
+func (c sharedCache) request(ctx context.Context, region, name string, body []byte) ([]byte, error) {
+	client := c.client(region)
+	if body != nil {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(c.Bucket),
+			Key:         aws.String(name),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+		return nil, err
+	}
+	result, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	return io.ReadAll(result.Body)
+}
+
+// loadSharedCache loads the target from the shared cache, and keeps it in the local cache as old as it is
+func loadSharedCache(cfg *Config) error {
+	if !sharedCacheable(cfg.InstanceName) {
+		return errSharedCacheMiss
+	}
+	c, err := parseSharedCache(cfg.SharedCache, cfg.S3Endpoint)
+	if err != nil {
+		return err
+	}
+	data, err := c.do(sharedCacheKey(cfg), nil)
+	if err != nil {
+		return err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || len(entry.Instance) == 0 {
+		return fmt.Errorf("invalid shared cache entry %s", sharedCacheKey(cfg))
+	}
+	if time.Since(entry.Saved) > cfg.CacheTTL {
+		return fmt.Errorf("shared cache entry is expired")
+	}
+	var instance Config
+	if err := json.Unmarshal(entry.Instance, &instance); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %v", err)
+	}
+	if err := verifySharedInstance(instance, cfg.InstanceName); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(entry.Instance, cfg); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %v", err)
+	}
+
+	entry.Profile = profileLabel(cfg)
+	if err := updateCacheDB(cfg.CacheDir, func(db *cacheDB) {
+		db.Entries[cacheEntryKey(cfg)] = entry
+	}); err != nil {
+		slog.Warn("failed to save cache", "error", err)
+	}
+	return nil
+}
+
+// saveSharedCache writes the entry of the target to the shared cache
+func saveSharedCache(cfg *Config, entry cacheEntry) error {
+	if !sharedCacheable(cfg.InstanceName) {
+		return nil
+	}
+	c, err := parseSharedCache(cfg.SharedCache, cfg.S3Endpoint)
+	if err != nil {
+		return err
+	}
+	// the profile name is the writer's own
+	entry.Profile = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry: %v", err)
+	}
+	_, err = c.do(sharedCacheKey(cfg), data)
+	return err
+}
+
+// sharedCacheable reports whether a shared cache entry of the target can be verified: names, instance IDs,
+// IP addresses and private DNS names can, stack resources, EKS nodes and managed instances can't
+func sharedCacheable(name string) bool {
+	target, _ := splitIndex(name)
+	return !strings.HasPrefix(target, "cfn:") && !strings.HasPrefix(target, "eks:") && !managedInstanceIDPattern.MatchString(target)
+}
+
+// verifySharedInstance checks the instance of a shared cache entry with DescribeInstances: anyone who can
+// write to the bucket could point the target anywhere, so the instance has to be in the caller's account,
+// running and named by the target
+func verifySharedInstance(instance Config, name string) error {
+	target, _ := splitIndex(name)
+	if instance.Hybrid || !instanceIDPattern.MatchString(instance.InstanceID) {
+		return fmt.Errorf("shared cache entry %s of %s can't be verified", instance.InstanceID, target)
+	}
+	client := ec2Client(func(o *ec2.Options) {
+		o.Region = instance.Region
+	})
+	instances, err := describeInstances(client, &ec2.DescribeInstancesInput{InstanceIds: []string{instance.InstanceID}})
+	if err != nil {
+		return fmt.Errorf("failed to verify shared cache entry %s: %v", instance.InstanceID, err)
+	}
+	if len(instances) != 1 || instances[0].State == nil || instances[0].State.Name != ec2Types.InstanceStateNameRunning ||
+		!instanceNamedBy(instances[0], target) {
+		return fmt.Errorf("shared cache entry %s is not a running instance named %s", instance.InstanceID, target)
+	}
+	return nil
+}
+
+// instanceNamedBy reports whether the target, an instance ID, IP address, private DNS name or Name tag,
+// names the instance
+func instanceNamedBy(instance ec2Types.Instance, target string) bool {
+	switch {
+	case instanceIDPattern.MatchString(target):
+		return aws.ToString(instance.InstanceId) == target
+	case net.ParseIP(target) != nil:
+		return target == aws.ToString(instance.PrivateIpAddress) || target == aws.ToString(instance.PublicIpAddress) ||
+			target == aws.ToString(instance.Ipv6Address)
+	case privateDNSPattern.MatchString(target):
+		return aws.ToString(instance.PrivateDnsName) == target
+	}
+	for _, tag := range instance.Tags {
+		if aws.ToString(tag.Key) == "Name" {
+			return aws.ToString(tag.Value) == target
+		}
+	}
+	return false
+}
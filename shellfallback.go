@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// errNoSSHServer ends an SSH session in which nothing answered on the port: sshd always greets first,
+// so sshd is not running or the port is closed
+var errNoSSHServer = errors.New("no SSH server answered")
+
+// noSSHServer returns errNoSSHServer with how to get a shell without SSH instead
+func noSSHServer() error {
+	profile := ""
+	if cfg.AwsProfile != "" {
+		profile = cfg.AwsProfile + " "
+	}
+	return fmt.Errorf("%w on port %s of %s, sshd may not be running or the port is closed; for a shell without SSH run: ssm-ssh-connect shell %s%s",
+		errNoSSHServer, cfg.Port, cmp.Or(cfg.InstanceID, cfg.InstanceName), profile, cfg.InstanceName)
+}
+
+// answerWriter records whether anything came back from the instance
+type answerWriter struct {
+	w        io.Writer
+	answered *atomic.Bool
+}
+
+func (w answerWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.answered.Store(true)
+	}
+	return w.w.Write(p)
+}
+
+// offerShell offers a plain shell session on the terminal when no SSH server answered. ssh is still waiting
+// for the server's greeting then, so the terminal is free to ask on and to run the shell in. Without a terminal,
+// or on Windows where the console can't be handed to the plugin, reason is returned, which tells how to get one.
+func offerShell(reason error) error {
+	tty, err := openTTY()
+	if err != nil {
+		return reason
+	}
+	defer tty.Close()
+	terminal, ok := tty.(*os.File)
+	if !ok {
+		return reason
+	}
+
+	fmt.Fprintf(terminal, "Nothing answered on port %s of %s, sshd may not be running or the port is closed.\nStart a Session Manager shell instead? [y/N] ", cfg.Port, cfg.InstanceID)
+	line, _ := bufio.NewReader(terminal).ReadString('\n')
+	if answer := strings.ToLower(strings.TrimSpace(line)); answer != "y" && answer != "yes" {
+		return reason
+	}
+	slog.Info("no SSH server answered, starting a shell session instead", "instance_id", cfg.InstanceID, "port", cfg.Port)
+	cfg.Shell = true
+	return runPluginSession(terminal, terminal)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminationSignals end the session, besides Ctrl-C. SIGHUP is among them only to be ignored (see shutdown).
+var terminationSignals = []os.Signal{syscall.SIGTERM, syscall.SIGHUP}
+
+// resizeSignals are relayed to the session's process, so a shell follows the terminal's size
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
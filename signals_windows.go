@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminationSignals end the session, besides Ctrl-C. Closing the console window, logging off and
+// shutting down arrive as SIGTERM.
+var terminationSignals = []os.Signal{syscall.SIGTERM}
+
+// resizeSignals are relayed to the session's process, Windows has none
+var resizeSignals []os.Signal
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// writeSSHConfig writes an ssh_config Host block for each of the instances carrying one of the tags (all
+// of them without tags), with a ProxyCommand running the executable for the profile. Instances are named
+// by their Name tag, or by their ID when they have none (or one ssh can't match); the user comes from
+// the config file's mapping. With --mux, ssh connections to a host share one connection.
+func writeSSHConfig(w io.Writer, rows []instanceRow, tags tagFilters, executable, profile string, user func(name string) string) {
+	if profile == "" {
+		profile = "-"
+	}
+	proxyCommand := shellQuote(executable) + " " + shellQuote(profile) + " %h %r"
+
+	fmt.Fprintf(w, "# generated by ssm-ssh-connect ssh-config for profile %s\n", profile)
+	var hosts []string
+	for _, row := range rows {
+		if len(tags) > 0 && !tags.matchesTags(row.Tags) {
+			continue
+		}
+		host := row.Name
+		if host == "" || strings.ContainsAny(host, " \t") {
+			// ssh_config splits Host patterns at whitespace
+			host = row.InstanceID
+		}
+		// ssh uses the first block of a name, and the ProxyCommand asks which of several instances to use
+		if slices.Contains(hosts, host) {
+			continue
+		}
+		hosts = append(hosts, host)
+
+		fmt.Fprintf(w, "\nHost %s\n", host)
+		if u := user(host); u != "" {
+			fmt.Fprintf(w, "  User %s\n", u)
+		}
+		fmt.Fprintf(w, "  ProxyCommand %s\n", proxyCommand)
+		fmt.Fprint(w, controlConfig())
+	}
+}
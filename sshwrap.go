@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// repeatable is implemented by flags that may be given several times
+type repeatable interface {
+	values() []string
+}
+
+// wrapperFlags are the flags that only concern the wrapping command, not the ProxyCommand it runs
+// (which gets the resolved instance, so there is nothing left to look up afresh)
+var wrapperFlags = []string{"D", "L", "forward", "region", "no-cache", "mux"}
+
+// proxyCommand returns an ssh ProxyCommand that runs this tool again for the already resolved instance,
+// passing along the flags given on the command line. Connecting by instance ID (in its region) keeps
+// the inner invocation from resolving the target again and gives ssh a stable host key name.
+func proxyCommand() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find own executable: %v", err)
+	}
+
+	args := []string{executable}
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(wrapperFlags, f.Name) {
+			return
+		}
+		if r, ok := f.Value.(repeatable); ok {
+			for _, v := range r.values() {
+				args = append(args, "-"+f.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	args = append(args, "-region="+cfg.Region)
+
+	profile := cfg.AwsProfile
+	if profile == "" {
+		profile = "-"
+	}
+	args = append(args, profile, cfg.InstanceID, "%r")
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// shellQuote quotes s for the shell that ssh runs the ProxyCommand with; %r is left for ssh to expand
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=.,/:%@+") == "" {
+		return s
+	}
+	if runtime.GOOS == "windows" {
+		return windowsQuote(s)
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// windowsQuote quotes s for a Windows command line, Windows OpenSSH starts the ProxyCommand without a POSIX shell
+func windowsQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// sshDestination returns the ssh destination of the resolved instance, which the ProxyCommand connects to
+func sshDestination() string {
+	return cfg.InstanceUser + "@" + cfg.InstanceID
+}
+
+// scpArgs turns remote paths written as :path into destination:path
+func scpArgs(args []string, destination string) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		if strings.HasPrefix(arg, ":") {
+			arg = destination + arg
+		}
+		result[i] = arg
+	}
+	return result
+}
+
+// wrappedCommand returns the ssh, scp or sftp command line of the command, or no program for commands
+// that hand the session to the session-manager-plugin directly
+func wrappedCommand(command string, passArgs []string) (string, []string) {
+	switch {
+	case command == "socks":
+		return "ssh", []string{"-N", "-D", cfg.SocksPort, sshDestination()}
+	case command == "cp":
+		return "scp", scpArgs(passArgs, sshDestination())
+	case command == "sftp":
+		return "sftp", append(passArgs, sshDestination())
+	case command == "forward" && len(cfg.Forwards) > 1:
+		return "ssh", append(cfg.Forwards.sshArgs(), "-N", sshDestination())
+	}
+	return "", nil
+}
+
+// sshArgs prepends the ProxyCommand running this tool, the identity, the keepalive and the --mux options to the arguments
+func sshArgs(args []string) ([]string, error) {
+	command, err := proxyCommand()
+	if err != nil {
+		return nil, err
+	}
+	result := append([]string{"-o", "ProxyCommand=" + command}, identityArgs()...)
+	result = append(append(result, keepaliveSSHArgs(cfg.Keepalive)...), controlArgs()...)
+	return append(result, args...), nil
+}
+
+// identityArgs makes ssh authenticate with the key the ProxyCommand pushes when it isn't one ssh tries
+// by itself, chosen with --identity or key_files. The private key is used when it sits next to the
+// public one, otherwise ssh finds it in the agent by the public key.
+func identityArgs() []string {
+	if cfg.Identity == "" && slices.Equal(cfg.KeyFiles, defaultKeyFiles) {
+		return nil
+	}
+	path, err := publicKeyPath(cfg.Identity, cfg.KeyFiles)
+	if err != nil {
+		// the ProxyCommand fails with the same error
+		return nil
+	}
+	if private := strings.TrimSuffix(path, ".pub"); private != path {
+		if _, err := os.Stat(private); err == nil {
+			path = private
+		}
+	}
+	return []string{"-i", path, "-o", "IdentitiesOnly=yes"}
+}
+
+// runSSH runs ssh, scp or sftp against the resolved instance through a ProxyCommand running this tool
+// and exits with its exit code
+func runSSH(program string, args ...string) {
+	args, err := sshArgs(args)
+	if err != nil {
+		slog.Error("failed to build ProxyCommand", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.Info("running "+program, "args", args)
+
+	cmd := exec.Command(program, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err == nil {
+		untrack := trackChild(cmd.Process)
+		err = cmd.Wait()
+		untrack()
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		slog.Error("failed to run "+program, "error", err)
+		fmt.Fprintf(os.Stderr, "Failed to run %s: %v\n", program, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
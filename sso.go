@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/smithy-go"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// isSSOTokenError reports whether err is caused by a missing, expired or revoked AWS SSO token
+func isSSOTokenError(err error) bool {
+	var tokenErr *ssocreds.InvalidTokenError
+	if errors.As(err, &tokenErr) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "UnauthorizedException" {
+		return true
+	}
+	return strings.Contains(err.Error(), "SSO token")
+}
+
+// ensureCredentials retrieves credentials up front, so an expired SSO session is reported to the user
+// (or refreshed with `aws sso login` when --sso-login is given) instead of failing somewhere later
+func ensureCredentials() error {
+	if awsConfig.Credentials == nil {
+		return fmt.Errorf("no AWS credentials configured for profile %s", profileLabel(&cfg))
+	}
+
+	ctx, cancel := apiContext()
+	defer cancel()
+	_, err := awsConfig.Credentials.Retrieve(ctx)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("no AWS credentials for profile %s within %v (--api-timeout), the credential provider is not responding", profileLabel(&cfg), cfg.APITimeout)
+	}
+	if !isSSOTokenError(err) {
+		return fmt.Errorf("unable to retrieve AWS credentials: %v", err)
+	}
+
+	slog.Warn("AWS SSO token is expired", "error", err)
+	args := []string{"sso", "login"}
+	if cfg.AwsProfile != "" {
+		args = append(args, "--profile", cfg.AwsProfile)
+	}
+	if !cfg.SSOLogin {
+		return fmt.Errorf("AWS SSO session has expired, run: aws %s", strings.Join(args, " "))
+	}
+
+	fmt.Fprintf(os.Stderr, "AWS SSO session has expired, running: aws %s\n", strings.Join(args, " "))
+	cmd := exec.Command("aws", args...)
+	// stdout belongs to the proxied SSH stream
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("aws sso login failed: %v", err)
+	}
+
+	// reload configuration to drop the provider's stale token
+	if err := loadAWSConfig(); err != nil {
+		return fmt.Errorf("unable to load AWS config: %v", err)
+	}
+	ctx, cancel = apiContext()
+	defer cancel()
+	if _, err := awsConfig.Credentials.Retrieve(ctx); err != nil {
+		return fmt.Errorf("unable to retrieve AWS credentials after SSO login: %v", err)
+	}
+	return nil
+}
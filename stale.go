@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"github.com/aws/smithy-go"
+	"log/slog"
+)
+
+// staleInstanceCodes are the API error codes telling that an instance ID no longer names a live target,
+// e.g. because its Auto Scaling group replaced it
+var staleInstanceCodes = map[string]bool{
+	"TargetNotConnected":               true,
+	"InvalidInstanceId":                true,
+	"InvalidInstanceID.NotFound":       true,
+	"InvalidInstanceID.Malformed":      true,
+	"EC2InstanceNotFoundException":     true,
+	"EC2InstanceStateInvalidException": true,
+}
+
+// staleInstance reports whether err says the instance is gone or no longer reachable
+func staleInstance(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && staleInstanceCodes[apiErr.ErrorCode()]
+}
+
+// instanceIDNotFound reports whether DescribeInstances failed because an instance ID it was given doesn't exist
+// in the region
+func instanceIDNotFound(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound"
+}
+
+// refreshCachedInstance drops the cache entry the instance was loaded from and resolves the target
+// again, so the failed step can be retried once. It reports whether there is a fresh instance to retry with.
+func refreshCachedInstance(reason error) bool {
+	if !cfg.FromCache {
+		return false
+	}
+	cfg.FromCache = false
+	slog.Info("cached instance is stale, resolving the target again", "instance", cfg.InstanceID, "error", reason)
+	if err := dropCache(&cfg); err != nil {
+		slog.Warn("failed to remove cache entry", "error", err)
+	}
+
+	stale := cfg.InstanceID
+	cfg.InstanceID, cfg.InstanceAZ, cfg.Hybrid, cfg.Platform = "", "", false, ""
+	if err := getInstanceDetails(); err != nil {
+		slog.Warn("failed to resolve the target again", "error", err)
+		return false
+	}
+	awsConfig.Region = cfg.Region
+	if err := saveCache(&cfg); err != nil {
+		slog.Warn("failed to save cache", "error", err)
+	}
+	// the same instance is not stale, just unavailable
+	return cfg.InstanceID != stale
+}
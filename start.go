@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// startTimeout limits how long we wait for a stopped instance to become running and SSM-online
+const startTimeout = 10 * time.Minute
+
+// startableStates are the instance states accepted by the resolver when --start is given
+var startableStates = []string{"pending", "running", "stopping", "stopped"}
+
+// preferRunning drops stopped instances from candidates if at least one of them is already running
+func preferRunning(instances []ec2Types.Instance) []ec2Types.Instance {
+	var running []ec2Types.Instance
+	for _, instance := range instances {
+		if instance.State != nil && instance.State.Name == ec2Types.InstanceStateNameRunning {
+			running = append(running, instance)
+		}
+	}
+	if len(running) == 0 {
+		return instances
+	}
+	return running
+}
+
+// ensureInstanceRunning starts the instance if it is stopped and waits until it is running and SSM-online
+func ensureInstanceRunning() error {
+	client := ec2Client()
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []string{cfg.InstanceID},
+	}
+
+	instances, err := describeInstances(client, input)
+	if err != nil {
+		return fmt.Errorf("failed to describe instance: %v", err)
+	}
+	if len(instances) == 0 || instances[0].State == nil {
+		return fmt.Errorf("instance %s not found", cfg.InstanceID)
+	}
+
+	state := instances[0].State.Name
+	slog.Info("instance state", "instance_id", cfg.InstanceID, "state", state)
+
+	switch state {
+	case ec2Types.InstanceStateNameRunning:
+		return nil
+	case ec2Types.InstanceStateNamePending:
+		// already starting
+	case ec2Types.InstanceStateNameStopping, ec2Types.InstanceStateNameStopped:
+		fmt.Fprintf(os.Stderr, "Instance %s is %s, starting it...\n", cfg.InstanceID, state)
+		if state == ec2Types.InstanceStateNameStopping {
+			if err := ec2.NewInstanceStoppedWaiter(client).Wait(context.Background(), input, startTimeout); err != nil {
+				return fmt.Errorf("failed to wait for instance to stop: %v", err)
+			}
+		}
+		ctx, cancel := apiContext()
+		defer cancel()
+		if _, err := client.StartInstances(ctx, &ec2.StartInstancesInput{
+			InstanceIds: []string{cfg.InstanceID},
+		}); err != nil {
+			return fmt.Errorf("failed to start instance: %v", err)
+		}
+	default:
+		return fmt.Errorf("instance %s is %s and cannot be started", cfg.InstanceID, state)
+	}
+
+	if err := ec2.NewInstanceRunningWaiter(client).Wait(context.Background(), input, startTimeout); err != nil {
+		return fmt.Errorf("failed to wait for instance to start: %v", err)
+	}
+	slog.Info("instance is running, waiting for SSM agent")
+
+	return waitForSSMOnline(startTimeout)
+}
+
+// waitForSSMOnline polls Systems Manager until the agent on the instance reports Online
+func waitForSSMOnline(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := getPingStatus(cfg.InstanceID)
+		if err != nil {
+			return err
+		}
+		if status == string(ssmTypes.PingStatusOnline) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("SSM agent on %s did not come online within %s", cfg.InstanceID, timeout)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
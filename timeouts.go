@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// defaultAPITimeout bounds an AWS API call, including the credential provider behind it, unless given otherwise
+const defaultAPITimeout = 30 * time.Second
+
+// connectDeadline ends the process when the session is not up within --connect-timeout
+var connectDeadline *time.Timer
+
+// apiContext returns the context of an AWS API call, which gives up after --api-timeout
+func apiContext() (context.Context, context.CancelFunc) {
+	if cfg.APITimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), cfg.APITimeout)
+}
+
+// startConnectDeadline gives up on the target with a clear error unless the session is up within the
+// timeout, whatever it is waiting for: an API call, the credential provider or a prompt
+func startConnectDeadline(timeout time.Duration, target string) {
+	if timeout <= 0 {
+		return
+	}
+	connectDeadline = time.AfterFunc(timeout, func() {
+		slog.Error("connect deadline exceeded", "timeout", timeout)
+		fmt.Fprintf(os.Stderr, "Gave up connecting to %s after %v (--connect-timeout)\n", target, timeout)
+		os.Exit(1)
+	})
+}
+
+// connected stops the connect deadline once the session is up
+func connected() {
+	if connectDeadline != nil {
+		connectDeadline.Stop()
+	}
+}
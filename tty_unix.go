@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// openTTY opens the controlling terminal, for prompts while stdin/stdout carry the proxied SSH stream
+func openTTY() (io.ReadWriteCloser, error) {
+	return os.OpenFile("/dev/tty", os.O_RDWR, 0)
+}
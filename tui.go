@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+)
+
+// browser is the state of the instance browser: the instances, the filter typed so far and the selected line
+type browser struct {
+	rows     []instanceRow
+	filter   string
+	selected int
+	offset   int
+}
+
+// browserAction is what a key press asks the browser to do
+type browserAction int
+
+const (
+	browserNone browserAction = iota
+	browserConnect
+	browserQuit
+	browserRefresh
+)
+
+// browseInstances shows the running instances full-screen, filtered as you type, and returns the ID of the
+// instance chosen with Enter, or "" when the browser was left without choosing one
+func browseInstances(in, out *os.File) (string, error) {
+	if !isTerminal(in) || !isTerminal(out) {
+		return "", fmt.Errorf("tui needs a terminal")
+	}
+	rows, err := runningInstances()
+	if err != nil {
+		return "", err
+	}
+
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return "", fmt.Errorf("failed to set up terminal: %v", err)
+	}
+	defer term.Restore(int(in.Fd()), state)
+	// the alternate screen keeps the shell's scrollback as it was
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	b := &browser{rows: rows}
+	key := make([]byte, 16)
+	for {
+		width, height, err := term.GetSize(int(out.Fd()))
+		if err != nil {
+			width, height = 80, 24
+		}
+		b.render(out, width, height)
+
+		n, err := in.Read(key)
+		if err != nil {
+			return "", err
+		}
+		switch b.handleKey(key[:n], height) {
+		case browserConnect:
+			if visible := b.visible(); len(visible) > 0 {
+				return visible[b.selected].InstanceID, nil
+			}
+		case browserQuit:
+			return "", nil
+		case browserRefresh:
+			rows, err := runningInstances()
+			if err != nil {
+				return "", err
+			}
+			b.rows = rows
+			b.moveTo(b.selected, height)
+		}
+	}
+}
+
+// visible returns the instances matching the filter
+func (b *browser) visible() []instanceRow {
+	return filterRows(b.rows, b.filter)
+}
+
+// handleKey applies the key press to the filter or the selection; arrow keys arrive as escape sequences
+func (b *browser) handleKey(key []byte, height int) browserAction {
+	switch k := string(key); {
+	case k == "\r" || k == "\n":
+		return browserConnect
+	case k == "\x1b" || k == "\x03" || k == "\x04":
+		// Esc, Ctrl-C, Ctrl-D
+		return browserQuit
+	case k == "\x12":
+		// Ctrl-R
+		return browserRefresh
+	case k == "\x1b[A" || k == "\x1bOA" || k == "\x10":
+		b.moveTo(b.selected-1, height)
+	case k == "\x1b[B" || k == "\x1bOB" || k == "\x0e":
+		b.moveTo(b.selected+1, height)
+	case k == "\x1b[5~":
+		b.moveTo(b.selected-listHeight(height), height)
+	case k == "\x1b[6~":
+		b.moveTo(b.selected+listHeight(height), height)
+	case k == "\x7f" || k == "\b":
+		if b.filter != "" {
+			_, size := utf8.DecodeLastRuneInString(b.filter)
+			b.filter = b.filter[:len(b.filter)-size]
+			b.moveTo(0, height)
+		}
+	case k == "\x15":
+		// Ctrl-U
+		b.filter = ""
+		b.moveTo(0, height)
+	default:
+		// typed or pasted text
+		if k != "" && utf8.ValidString(k) && strings.IndexFunc(k, func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+			b.filter += k
+			b.moveTo(0, height)
+		}
+	}
+	return browserNone
+}
+
+// moveTo selects the line, kept within the visible instances, and scrolls it into view
+func (b *browser) moveTo(line, height int) {
+	b.selected = max(0, min(line, len(b.visible())-1))
+	lines := listHeight(height)
+	if b.selected < b.offset {
+		b.offset = b.selected
+	}
+	if b.selected >= b.offset+lines {
+		b.offset = b.selected - lines + 1
+	}
+}
+
+// listHeight returns the number of instance lines that fit the screen below the filter and header lines
+func listHeight(height int) int {
+	return max(1, height-3)
+}
+
+// render draws the browser; in raw mode a line break needs the carriage return
+func (b *browser) render(w io.Writer, width, height int) {
+	visible := b.visible()
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tINSTANCE ID\tAZ\tPRIVATE IP\tSSM STATUS")
+	for _, row := range visible {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", row.Name, row.InstanceID, row.AvailabilityZone, row.PrivateIP, row.SSMStatus)
+	}
+	tw.Flush()
+	lines := strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H\x1b[2J")
+	screen.WriteString(truncate(fmt.Sprintf("Filter: %s  (%d of %d, Enter connects, Ctrl-R refreshes, Esc quits)", b.filter, len(visible), len(b.rows)), width))
+	screen.WriteString("\r\n\x1b[1m" + truncate(lines[0], width) + "\x1b[0m")
+	end := min(len(visible), b.offset+listHeight(height))
+	for i := b.offset; i < end; i++ {
+		line := truncate(lines[i+1], width)
+		if i == b.selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		screen.WriteString("\r\n" + line)
+	}
+	io.WriteString(w, screen.String())
+}
+
+// truncate cuts the line to the screen width
+func truncate(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:max(0, width)])
+}
+
+// filterRows returns the instances matching every word of the filter, case-insensitively, in their name,
+// instance ID, private IP or a tag written as Key=Value, e.g. "env=prod web"
+func filterRows(rows []instanceRow, filter string) []instanceRow {
+	words := strings.Fields(strings.ToLower(filter))
+	var matches []instanceRow
+	for _, row := range rows {
+		fields := []string{row.Name, row.InstanceID, row.PrivateIP}
+		for key, value := range row.Tags {
+			fields = append(fields, key+"="+value)
+		}
+		text := strings.ToLower(strings.Join(fields, "\n"))
+		matched := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, row)
+		}
+	}
+	return matches
+}
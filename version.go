@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// build metadata, set by the release build with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// buildInfo returns the version, commit and build date, falling back to what go build and go install record
+func buildInfo() (string, string, string) {
+	v, c, d := version, commit, date
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v, c, d
+	}
+	if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		// go install github.com/scmrus/ssm-ssh-connect@v1.2.3
+		v = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && c == "":
+			c = setting.Value
+		case setting.Key == "vcs.time" && d == "":
+			d = setting.Value
+		}
+	}
+	return v, c, d
+}
+
+// minPluginVersion is the oldest session-manager-plugin known to work with every session document used here,
+// the first with port forwards to remote hosts, which forward, db and kube start. Older plugins fail in
+// confusing ways with them.
+const minPluginVersion = "1.2.285.0"
+
+// pluginVersion returns the version the session-manager-plugin reports
+func pluginVersion() (string, error) {
+	pluginPath, err := findPlugin()
+	if err != nil {
+		return "", err
+	}
+	return runPluginVersion(pluginPath)
+}
+
+func runPluginVersion(pluginPath string) (string, error) {
+	output, err := exec.Command(pluginPath, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get session-manager-plugin version: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// pluginInfo is the version of a plugin binary, cached with its size and modification time,
+// so the plugin is asked once per install rather than on every connection
+type pluginInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Version string    `json:"version"`
+}
+
+// cachedPluginVersion returns the version of the plugin binary, from the cache while the binary is unchanged
+func cachedPluginVersion(cacheDir, pluginPath string) (string, error) {
+	stat, err := os.Stat(pluginPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat session-manager-plugin: %v", err)
+	}
+	info := pluginInfo{Path: pluginPath, Size: stat.Size(), ModTime: stat.ModTime().UTC()}
+	if db, err := readCacheDB(cacheDir); err == nil && db.Plugin != nil {
+		cached := *db.Plugin
+		if cached.Path == info.Path && cached.Size == info.Size && cached.ModTime.Equal(info.ModTime) {
+			return cached.Version, nil
+		}
+	}
+
+	info.Version, err = runPluginVersion(pluginPath)
+	if err != nil {
+		return "", err
+	}
+	if err := updateCacheDB(cacheDir, func(db *cacheDB) { db.Plugin = &info }); err != nil {
+		slog.Warn("failed to cache the session-manager-plugin version", "error", err)
+	}
+	return info.Version, nil
+}
+
+// olderVersion reports whether the dotted version is older than min. Versions that don't parse are not,
+// a plugin built from source may report anything.
+func olderVersion(version, min string) bool {
+	parse := func(v string) []int {
+		var parts []int
+		for _, field := range strings.Split(v, ".") {
+			n, err := strconv.Atoi(field)
+			if err != nil {
+				return nil
+			}
+			parts = append(parts, n)
+		}
+		return parts
+	}
+	v, m := parse(version), parse(min)
+	if v == nil || m == nil {
+		return false
+	}
+	for i := range m {
+		if i >= len(v) {
+			return true
+		}
+		if v[i] != m[i] {
+			return v[i] < m[i]
+		}
+	}
+	return false
+}
+
+// checkPluginVersion logs the plugin's version and warns when it is older than minPluginVersion
+func checkPluginVersion(pluginPath string) {
+	version, err := cachedPluginVersion(cfg.CacheDir, pluginPath)
+	if err != nil {
+		slog.Warn("unknown session-manager-plugin version", "path", pluginPath, "error", err)
+		return
+	}
+	slog.Info("session-manager-plugin", "path", pluginPath, "version", version)
+	if olderVersion(version, minPluginVersion) {
+		slog.Warn("session-manager-plugin is too old", "version", version, "minimum", minPluginVersion)
+		fmt.Fprintf(os.Stderr, "Warning: session-manager-plugin %s is older than %s and may fail in confusing ways, please update it\n", version, minPluginVersion)
+	}
+}
+
+// versionText formats the version report for bug reports
+func versionText(v, c, d, plugin string) string {
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	return fmt.Sprintf("ssm-ssh-connect %s\ncommit: %s\nbuilt: %s\ngo: %s %s/%s\nsession-manager-plugin: %s\n",
+		v, unknown(c), unknown(d), runtime.Version(), runtime.GOOS, runtime.GOARCH, plugin)
+}
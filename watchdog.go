@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// activity records when data last went through the session
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+type activityReader struct {
+	r        io.Reader
+	activity *activity
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.activity.touch()
+	}
+	return n, err
+}
+
+type activityWriter struct {
+	w        io.Writer
+	activity *activity
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	w.activity.touch()
+	return w.w.Write(p)
+}
+
+// watchdogReason returns why the session has to end, or an empty string if it may go on
+func watchdogReason(elapsed, idle, maxDuration, idleTimeout time.Duration) string {
+	if maxDuration > 0 && elapsed >= maxDuration {
+		return fmt.Sprintf("session reached the maximum duration of %v", maxDuration)
+	}
+	if idleTimeout > 0 && idle >= idleTimeout {
+		return fmt.Sprintf("session was idle for %v", idleTimeout)
+	}
+	return ""
+}
+
+// errSessionLimit ends a session that reached --max-duration or --idle-timeout, which is not reconnected
+var errSessionLimit = errors.New("session limit reached")
+
+// firstSessionStart is when the first session of the invocation started, --max-duration holds across reconnects
+var firstSessionStart time.Time
+
+// watchSession ends the session once it exceeds --max-duration or --idle-timeout, or once ended is closed:
+// the session is terminated on the SSM side, so it can't be resumed, and the plugin is stopped. Idle time is only
+// measured on the session's stdin/stdout, which port forwards don't use. stop returns errSessionLimit when
+// a limit ended the session.
+func watchSession(sessionID string, cmd *exec.Cmd, activity *activity, ended <-chan struct{}) (stop func() error) {
+	done := make(chan struct{})
+	if firstSessionStart.IsZero() {
+		firstSessionStart = time.Now()
+	}
+	started := firstSessionStart
+	activity.touch()
+	var limit atomic.Pointer[error]
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			reason := ""
+			select {
+			case <-done:
+				return
+			case <-ended:
+				reason = "client exited"
+			case <-ticker.C:
+				reason = watchdogReason(time.Since(started), activity.idle(), cfg.MaxDuration, cfg.IdleTimeout)
+				if reason != "" {
+					fmt.Fprintf(os.Stderr, "Terminating session: %s\n", reason)
+					err := fmt.Errorf("%w: %s", errSessionLimit, reason)
+					limit.Store(&err)
+				}
+			}
+			if reason == "" {
+				continue
+			}
+
+			slog.Warn("terminating session", "session_id", sessionID, "reason", reason)
+			if err := terminateSession(ssmClient(), sessionID); err != nil {
+				slog.Error("failed to terminate session", "error", err)
+			}
+			cmd.Process.Kill()
+			return
+		}
+	}()
+
+	return func() error {
+		close(done)
+		if err := limit.Load(); err != nil {
+			return *err
+		}
+		return nil
+	}
+}
+
+// terminateSession ends the session on the SSM side, so it can't be resumed. The plugin doesn't always end
+// it on its way out, and the session then lingers as Connected and counts against the connection limits.
+func terminateSession(client *ssm.Client, sessionID string) error {
+	ctx, cancel := apiContext()
+	defer cancel()
+	_, err := client.TerminateSession(ctx, &ssm.TerminateSessionInput{
+		SessionId: aws.String(sessionID),
+	})
+	return err
+}